@@ -0,0 +1,321 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Directory next to the document with the receipts of its entries
+const attachmentsDir = "attachments"
+
+const maxAttachmentSize = 10 << 20
+
+var (
+  // Accepted receipts, by detected content type
+  attachmentTypes = map[string]string{
+    "image/jpeg": ".jpg",
+    "image/png": ".png",
+    "image/gif": ".gif",
+    "image/webp": ".webp",
+    "application/pdf": ".pdf",
+  }
+
+  // Attachments are named by the SHA-256 of their content
+  attachmentPattern = regexp.MustCompile(`^[0-9a-f]{64}\.(jpg|png|gif|webp|pdf)$`)
+)
+
+
+// *******************************
+// Attachments directory of a document file
+// *******************************
+func attachmentsDirOf(path string) string {
+  return filepath.Join(filepath.Dir(path), attachmentsDir)
+}
+
+
+// *******************************
+// Check if the receipt of the entry can be shown as a thumbnail
+// *******************************
+func (entry EntryRec) HasImage() bool {
+  return entry.Attachment != "" && filepath.Ext(entry.Attachment) != ".pdf"
+}
+
+
+// *******************************
+// Store a receipt by its content and return its name
+// The same receipt uploaded twice is stored once. Receipts of
+// encrypted documents are encrypted with the same passphrase
+// *******************************
+func (doc *Document) storeAttachment(file io.Reader) (string, error) {
+  data, err := ioutil.ReadAll(io.LimitReader(file, maxAttachmentSize + 1))
+  if err != nil {
+    return "", err
+  }
+  if len(data) > maxAttachmentSize {
+    return "", fmt.Errorf("Receipts can not be larger than %d MB", maxAttachmentSize >> 20)
+  }
+  ext, ok := attachmentTypes[http.DetectContentType(data)]
+  if !ok {
+    return "", fmt.Errorf("Receipts must be JPEG, PNG, GIF, WebP or PDF files")
+  }
+  sum := sha256.Sum256(data)
+  name := hex.EncodeToString(sum[:]) + ext
+
+  path := filepath.Join(doc.attachments, name)
+  if _, err := os.Stat(path); err == nil && (doc.passphrase == "" || attachmentEncrypted(path)) {
+    return name, nil
+  }
+  if data, err = doc.encodeAttachment(data); err != nil {
+    return "", err
+  }
+  return name, writeAttachment(doc.attachments, name, data)
+}
+
+
+// *******************************
+// Receipt content as stored, encrypted when the document is
+// *******************************
+func (doc *Document) encodeAttachment(data []byte) ([]byte, error) {
+  if doc.passphrase == "" {
+    return data, nil
+  }
+  return encryptDocument(data, doc.passphrase)
+}
+
+
+// *******************************
+// Receipt content, decrypted if it was stored encrypted
+// *******************************
+func readAttachment(path, passphrase string) ([]byte, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil || !isEncrypted(data) {
+    return data, err
+  }
+  return decryptDocument(data, passphrase)
+}
+
+
+// *******************************
+// Check if a stored receipt is encrypted, only reading its start
+// *******************************
+func attachmentEncrypted(path string) bool {
+  file, err := os.Open(path)
+  if err != nil {
+    return false
+  }
+  defer file.Close()
+  head := make([]byte, 64)
+  n, _ := io.ReadFull(file, head)
+  return bytes.Contains(head[:n], []byte(encryptedFormat))
+}
+
+
+// *******************************
+// Write a receipt apart and rename it, so a partial
+// file never has the name
+// *******************************
+func writeAttachment(dir, name string, data []byte) error {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return err
+  }
+  tmp, err := ioutil.TempFile(dir, ".upload-*")
+  if err != nil {
+    return err
+  }
+  if _, err := tmp.Write(data); err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  return nil
+}
+
+
+// *******************************
+// Encrypt the receipts stored in plain text before the
+// document had a passphrase
+// *******************************
+func (doc *Document) encryptAttachments(dir string) error {
+  for _, name := range doc.attachmentNames() {
+    path := filepath.Join(dir, name)
+    if _, err := os.Stat(path); err != nil || attachmentEncrypted(path) {
+      continue
+    }
+    data, err := ioutil.ReadFile(path)
+    if err == nil {
+      data, err = doc.encodeAttachment(data)
+    }
+    if err == nil {
+      err = writeAttachment(dir, name, data)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// *******************************
+// Attachments used by the entries of the document, sorted
+// *******************************
+func (doc *Document) attachmentNames() []string {
+  var names []string
+  add := func(entries []EntryRec) {
+    for _, entry := range entries {
+      if entry.Attachment != "" && !containsStr(names, entry.Attachment) {
+        names = append(names, entry.Attachment)
+      }
+    }
+  }
+  for _, month := range doc.MonthRecs {
+    add(month.EntryRecords)
+  }
+  add(doc.Inbox)
+  sort.Strings(names)
+  return names
+}
+
+
+// *******************************
+// Copy the attachments of the document to another directory,
+// used when the document is written somewhere else. Each one
+// is taken from the first directory that has it, decrypted with
+// the passphrase it was read with, and stored as the document is
+// *******************************
+func (doc *Document) copyAttachments(passphrase, toDir string, fromDirs ...string) error {
+  for _, name := range doc.attachmentNames() {
+    if _, err := os.Stat(filepath.Join(toDir, name)); err == nil {
+      continue
+    }
+    var data []byte
+    err := fmt.Errorf("Receipt %s not found", name)
+    for _, fromDir := range fromDirs {
+      if data, err = readAttachment(filepath.Join(fromDir, name), passphrase); !errors.Is(err, os.ErrNotExist) {
+        break
+      }
+    }
+    if err == nil {
+      data, err = doc.encodeAttachment(data)
+    }
+    if err == nil {
+      err = writeAttachment(toDir, name, data)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// *******************************
+// Serve a receipt of the document to its viewers
+// Only the checks hold the document lock, so decrypting
+// receipts doesn't block the other requests
+// *******************************
+func (doc *Document) attachmentHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    doc.mutex.Lock()
+    allowed := doc.hasRole(currentUser(r), roleViewer)
+    dir, passphrase := doc.attachments, doc.passphrase
+    doc.mutex.Unlock()
+    if !allowed {
+      http.Error(w, "Forbidden: " + roleViewer + " role needed", http.StatusForbidden)
+      return
+    }
+
+    name := r.FormValue("name")
+    if !attachmentPattern.MatchString(name) {
+      http.NotFound(w, r)
+      return
+    }
+    data, err := readAttachment(filepath.Join(dir, name), passphrase)
+    if err != nil {
+      http.NotFound(w, r)
+      return
+    }
+    // Receipts never change, as they are named by their content
+    w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+  }
+}
+
+
+// *******************************
+// Zip archive with the document and its receipts as saved,
+// encrypted when the document is
+// *******************************
+func (doc *Document) writeBackup(w io.Writer) error {
+  data, err := doc.encode()
+  if err != nil {
+    return err
+  }
+  archive := zip.NewWriter(w)
+  file, err := archive.Create("apunta.json")
+  if err != nil {
+    return err
+  }
+  if _, err := file.Write(data); err != nil {
+    return err
+  }
+
+  for _, name := range doc.attachmentNames() {
+    data, err := ioutil.ReadFile(filepath.Join(doc.attachments, name))
+    if err != nil {
+      return err
+    }
+    file, err := archive.Create(attachmentsDir + "/" + name)
+    if err != nil {
+      return err
+    }
+    if _, err := file.Write(data); err != nil {
+      return err
+    }
+  }
+  return archive.Close()
+}
+
+
+// *******************************
+// Download a backup of the document with its receipts
+// *******************************
+func (doc *Document) backupHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    var buffer bytes.Buffer
+    if err := doc.writeBackup(&buffer); err != nil {
+      doc.addNotice("Backup failed: " + err.Error())
+      doc.render(w, r)
+      return
+    }
+    name := "apunta_backup"
+    if doc.basePath != "" {
+      name = strings.TrimPrefix(doc.basePath, "/doc/") + "_backup"
+    }
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"" + name + ".zip\"")
+    w.Write(buffer.Bytes())
+  }
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+  "fmt"
+  "html/template"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var auditTpl = template.Must(template.ParseFiles("audit.html"))
+
+// Change of one value of the document, stored with the document
+// Before is empty for additions and After for deletions
+type AuditEvent struct {
+  Time       time.Time
+  User       string
+  Operation  string
+  Action     string
+  Object     string
+  Field      string
+  Before     string
+  After      string
+}
+
+// Criteria to select audit events, empty fields match everything
+type AuditFilter struct {
+  User      string
+  Action    string
+  Text      string
+  FromDate  time.Time
+  ToDate    time.Time
+}
+
+// Entry found in the document with the sheet holding it
+type auditEntry struct {
+  entry  EntryRec
+  sheet  string
+}
+
+
+// *******************************
+// Short description of an entry for the audit log
+// *******************************
+func describeEntry(entry EntryRec) string {
+  payer := entry.PersonName
+  if entry.SharedGroup != "" {
+    payer = entry.SharedGroup
+  }
+  text := fmt.Sprintf("%s %s %.2f %s by %s", entry.Date.Format("2006-01-02"), entry.Category, entry.Amount, entry.Currency, payer)
+  if entry.Kind != kindExpense {
+    text = entry.Kind + ": " + text
+  }
+  if entry.Comment != "" {
+    text += " (" + entry.Comment + ")"
+  }
+  return text
+}
+
+
+// *******************************
+// Entries of the document by ID, the inbox counts as a sheet
+// *******************************
+func entriesByID(doc *Document) map[string]auditEntry {
+  entries := map[string]auditEntry{}
+  for _, month := range doc.MonthRecs {
+    for _, entry := range month.EntryRecords {
+      entries[entry.ID] = auditEntry{entry, month.GroupName}
+    }
+  }
+  for _, entry := range doc.Inbox {
+    entries[entry.ID] = auditEntry{entry, "Inbox"}
+  }
+  return entries
+}
+
+
+// *******************************
+// Fields of an entry compared in the audit log
+// The exchange rate is only compared when set by hand
+// *******************************
+func entryFields(item auditEntry) map[string]string {
+  entry := item.entry
+  fields := map[string]string{
+    "Sheet": item.sheet,
+    "Kind": entry.Kind,
+    "Date": entry.Date.Format("2006-01-02"),
+    "Category": entry.Category,
+    "Payer": entry.PersonName,
+    "Shared": entry.SharedGroup,
+    "Currency": entry.Currency,
+    "Amount": strconv.FormatFloat(entry.Amount, 'f', 2, 64),
+    "Comment": entry.Comment,
+    "RefundOf": entry.RefundOf,
+    "Receipt": entry.Attachment,
+  }
+  if entry.ManualRate {
+    fields["Rate"] = strconv.FormatFloat(entry.ExchRate, 'f', -1, 64)
+  }
+  return fields
+}
+
+
+// *******************************
+// Changes of the entries, matched by ID
+// *******************************
+func entryChanges(before, after *Document) []AuditEvent {
+  var events []AuditEvent
+  oldEntries := entriesByID(before)
+  newEntries := entriesByID(after)
+
+  for id, item := range newEntries {
+    old, ok := oldEntries[id]
+    if !ok {
+      events = append(events, AuditEvent{Action: "entry added", Object: id, After: describeEntry(item.entry)})
+      continue
+    }
+    oldFields := entryFields(old)
+    for field, value := range entryFields(item) {
+      if oldFields[field] != value {
+        events = append(events, AuditEvent{Action: "entry edited", Object: id, Field: field, Before: oldFields[field], After: value})
+      }
+    }
+    if _, ok := entryFields(item)["Rate"]; !ok && old.entry.ManualRate {
+      events = append(events, AuditEvent{Action: "entry edited", Object: id, Field: "Rate", Before: oldFields["Rate"]})
+    }
+  }
+  for id, item := range oldEntries {
+    if _, ok := newEntries[id]; !ok {
+      events = append(events, AuditEvent{Action: "entry deleted", Object: id, Before: describeEntry(item.entry)})
+    }
+  }
+  return events
+}
+
+
+// *******************************
+// Changes of a list of names: a single name replaced by
+// another is a rename
+// *******************************
+func listChanges(kind string, before, after []string) []AuditEvent {
+  var added, removed []string
+  for _, name := range after {
+    if !containsStr(before, name) {
+      added = append(added, name)
+    }
+  }
+  for _, name := range before {
+    if !containsStr(after, name) {
+      removed = append(removed, name)
+    }
+  }
+
+  if len(added) == 1 && len(removed) == 1 {
+    return []AuditEvent{{Action: kind + " renamed", Object: removed[0], Before: removed[0], After: added[0]}}
+  }
+  var events []AuditEvent
+  for _, name := range added {
+    events = append(events, AuditEvent{Action: kind + " added", Object: name, After: name})
+  }
+  for _, name := range removed {
+    events = append(events, AuditEvent{Action: kind + " removed", Object: name, Before: name})
+  }
+  return events
+}
+
+
+// *******************************
+// Changes of values stored by name, like debts or roles
+// *******************************
+func valueChanges(action string, before, after map[string]string) []AuditEvent {
+  var events []AuditEvent
+  for name, value := range after {
+    if before[name] != value {
+      events = append(events, AuditEvent{Action: action, Object: name, Before: before[name], After: value})
+    }
+  }
+  for name, value := range before {
+    if _, ok := after[name]; !ok {
+      events = append(events, AuditEvent{Action: action, Object: name, Before: value})
+    }
+  }
+  return events
+}
+
+func debtValues(debts map[string]float64) map[string]string {
+  values := map[string]string{}
+  for name, debt := range debts {
+    values[name] = strconv.FormatFloat(debt, 'f', 2, 64)
+  }
+  return values
+}
+
+
+// *******************************
+// Changes of the sheets, matched by name
+// *******************************
+func sheetChanges(before, after *Document) []AuditEvent {
+  var oldNames, newNames []string
+  oldClosed := map[string]bool{}
+  for _, month := range before.MonthRecs {
+    oldNames = append(oldNames, month.GroupName)
+    oldClosed[month.GroupName] = month.Closed
+  }
+  events := []AuditEvent{}
+  for _, month := range after.MonthRecs {
+    newNames = append(newNames, month.GroupName)
+    if closed, ok := oldClosed[month.GroupName]; ok && closed != month.Closed {
+      action := "sheet closed"
+      if !month.Closed {
+        action = "sheet reopened"
+      }
+      events = append(events, AuditEvent{Action: action, Object: month.GroupName})
+    }
+  }
+  return append(listChanges("sheet", oldNames, newNames), events...)
+}
+
+
+// *******************************
+// All the changes between two states of the document
+// Changes not described in detail are logged as a whole
+// *******************************
+func auditChanges(before, after *Document) []AuditEvent {
+  var events []AuditEvent
+  events = append(events, entryChanges(before, after)...)
+  events = append(events, listChanges("category", before.Categories, after.Categories)...)
+  events = append(events, listChanges("payer", before.Payers, after.Payers)...)
+  events = append(events, listChanges("currency", before.Currencies, after.Currencies)...)
+  events = append(events, sheetChanges(before, after)...)
+  events = append(events, valueChanges("debt adjusted", debtValues(before.PrevDebt), debtValues(after.PrevDebt))...)
+  events = append(events, valueChanges("role changed", before.Roles, after.Roles)...)
+
+  // Stable order within an operation
+  sort.SliceStable(events, func(i, j int) bool {
+    if events[i].Action != events[j].Action {
+      return events[i].Action < events[j].Action
+    }
+    if events[i].Object != events[j].Object {
+      return events[i].Object < events[j].Object
+    }
+    return events[i].Field < events[j].Field
+  })
+  return events
+}
+
+
+// *******************************
+// Add the changes made by an operation to the audit log
+// *******************************
+func (doc *Document) audit(before *Document, op Operation) {
+  events := auditChanges(before, doc)
+  if len(events) == 0 {
+    events = append(events, AuditEvent{Action: "document changed", Object: op.Params})
+  }
+  for _, event := range events {
+    event.Time = op.Time
+    event.User = op.User
+    event.Operation = op.Name
+    doc.Audit = append(doc.Audit, event)
+  }
+}
+
+
+// *******************************
+// Check if an event fulfills all the filter criteria
+// *******************************
+func (filter AuditFilter) matches(event AuditEvent) bool {
+  if filter.User != "" && event.User != filter.User {
+    return false
+  }
+  if filter.Action != "" && !strings.HasPrefix(event.Action, filter.Action) {
+    return false
+  }
+  if filter.Text != "" {
+    text := strings.ToLower(filter.Text)
+    found := false
+    for _, value := range []string{event.Object, event.Field, event.Before, event.After} {
+      if strings.Contains(strings.ToLower(value), text) {
+        found = true
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  if !filter.FromDate.IsZero() && event.Time.Before(filter.FromDate) {
+    return false
+  }
+  if !filter.ToDate.IsZero() && !event.Time.Before(filter.ToDate.AddDate(0, 0, 1)) {
+    return false
+  }
+  return true
+}
+
+
+// *******************************
+// Events of the audit log matching the filter, newest first
+// *******************************
+func (doc *Document) filterAudit(filter AuditFilter) []AuditEvent {
+  var events []AuditEvent
+  for index := len(doc.Audit) - 1; index >= 0; index-- {
+    if filter.matches(doc.Audit[index]) {
+      events = append(events, doc.Audit[index])
+    }
+  }
+  return events
+}
+
+
+// *******************************
+// Read the audit filter from the query parameters
+// *******************************
+func parseAuditFilter(r *http.Request) AuditFilter {
+  filter := AuditFilter{
+    User: strings.TrimSpace(r.FormValue("user")),
+    Action: r.FormValue("action"),
+    Text: strings.TrimSpace(r.FormValue("text")),
+  }
+  if date, err := time.Parse("2006-01-02", r.FormValue("from")); err == nil {
+    filter.FromDate = date
+  }
+  if date, err := time.Parse("2006-01-02", r.FormValue("to")); err == nil {
+    filter.ToDate = date
+  }
+  return filter
+}
+
+
+// *******************************
+// Page with the audit log and its filter
+// *******************************
+func (doc *Document) auditHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    filter := parseAuditFilter(r)
+
+    users := []string{}
+    actions := []string{}
+    for _, event := range doc.Audit {
+      if event.User != "" && !containsStr(users, event.User) {
+        users = append(users, event.User)
+      }
+      kind := strings.Fields(event.Action)[0]
+      if !containsStr(actions, kind) {
+        actions = append(actions, kind)
+      }
+    }
+    sort.Strings(users)
+    sort.Strings(actions)
+
+    data := struct {
+      Doc      *Document
+      Filter   AuditFilter
+      Users    []string
+      Actions  []string
+      Events   []AuditEvent
+    }{doc, filter, users, actions, doc.filterAudit(filter)}
+    if err := auditTpl.Execute(w, data); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "html/template"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+const (
+  sessionCookieName = "apunta_session"
+  sessionDuration   = 7 * 24 * time.Hour
+  defaultUsersFile  = "apunta_users.json"
+  usersFileEnv      = "APUNTA_USERS_FILE"
+)
+
+var (
+  loginTpl = template.Must(template.ParseFiles("login.html"))
+
+  // Cost of the password hashes, lowered in tests
+  bcryptCost = bcrypt.DefaultCost
+)
+
+type ctxKey int
+
+const userCtxKey ctxKey = 0
+
+// Account allowed to use the server, linked to a payer of the documents
+type UserAccount struct {
+  Name          string
+  PasswordHash  string
+  Payer         string
+  // Admins create the accounts of the server
+  Admin         bool
+}
+
+type session struct {
+  userName  string
+  expires   time.Time
+}
+
+// Accounts stored in a local JSON file and sessions kept in memory
+type UserStore struct {
+  Users     []UserAccount
+
+  path      string
+  mutex     sync.Mutex
+  sessions  map[string]session
+}
+
+// Data shown in every page: the document and the logged in user
+type pageData struct {
+  *Document
+  User  *UserAccount
+}
+
+
+// *******************************
+// Payer selected by default: the one of the user, or the last used
+// *******************************
+func (page pageData) DefaultPayer() string {
+  if page.User != nil && page.User.Payer != "" && !page.IsInactivePayer(page.User.Payer) {
+    return page.User.Payer
+  }
+  return page.LastUsedPayer
+}
+
+
+// *******************************
+// Check if the logged in user can create accounts
+// *******************************
+func (page pageData) IsAdmin() bool {
+  return page.User != nil && page.User.Admin
+}
+
+
+// *******************************
+// Load the accounts file, a missing file means no accounts yet
+// *******************************
+func loadUserStore(path string) (*UserStore, error) {
+  store := &UserStore{path: path, sessions: map[string]session{}}
+
+  byteValue, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return store, nil
+  } else if err != nil {
+    return nil, err
+  }
+  if err := json.Unmarshal(byteValue, &store.Users); err != nil {
+    return nil, err
+  }
+
+  // Files written before admins existed: the first account was the
+  // one created on the first start
+  admins := 0
+  for _, user := range store.Users {
+    if user.Admin {
+      admins++
+    }
+  }
+  if admins == 0 && len(store.Users) > 0 {
+    store.Users[0].Admin = true
+  }
+  return store, nil
+}
+
+
+// *******************************
+// Write the accounts file, only readable by the owner
+// *******************************
+func (store *UserStore) save() error {
+  b, err := json.MarshalIndent(store.Users, "", " ")
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(store.path, b, 0600)
+}
+
+
+// *******************************
+// Find an account by name
+// *******************************
+func (store *UserStore) findUser(name string) *UserAccount {
+  for index := range store.Users {
+    if store.Users[index].Name == name {
+      return &store.Users[index]
+    }
+  }
+  return nil
+}
+
+
+// *******************************
+// Accounts file, set in APUNTA_USERS_FILE or the default
+// *******************************
+func usersFilePath() string {
+  if path := os.Getenv(usersFileEnv); path != "" {
+    return path
+  }
+  return defaultUsersFile
+}
+
+
+// *******************************
+// Create a new account with a hashed password
+// *******************************
+func (store *UserStore) addUser(name, password, payer string, admin bool) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+
+  if name == "" || password == "" {
+    return fmt.Errorf("User name and password can not be empty")
+  }
+  if store.findUser(name) != nil {
+    return fmt.Errorf("User %s already exists", name)
+  }
+
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+  if err != nil {
+    return err
+  }
+  store.Users = append(store.Users, UserAccount{name, string(hash), payer, admin})
+  return store.save()
+}
+
+
+// *******************************
+// Link the accounts of a document to the new name of their payer,
+// after it was renamed or merged into another one
+// *******************************
+func (store *UserStore) relinkPayer(doc *Document, oldName, newName string) error {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+
+  changed := false
+  for index := range store.Users {
+    user := &store.Users[index]
+    if user.Payer == oldName && doc.hasRole(user, roleViewer) {
+      user.Payer = newName
+      changed = true
+    }
+  }
+  if !changed || store.path == "" {
+    return nil
+  }
+  return store.save()
+}
+
+
+// *******************************
+// Check the password and open a session, returning its token
+// *******************************
+func (store *UserStore) login(name, password string) (string, error) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+
+  user := store.findUser(name)
+  if user == nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+    return "", fmt.Errorf("Wrong user name or password")
+  }
+
+  b := make([]byte, 32)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  token := hex.EncodeToString(b)
+  store.sessions[token] = session{name, time.Now().Add(sessionDuration)}
+  return token, nil
+}
+
+
+// *******************************
+// Find the user of a session token, expired sessions are removed
+// *******************************
+func (store *UserStore) sessionUser(token string) *UserAccount {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+
+  sess, ok := store.sessions[token]
+  if !ok {
+    return nil
+  }
+  if time.Now().After(sess.expires) {
+    delete(store.sessions, token)
+    return nil
+  }
+  return store.findUser(sess.userName)
+}
+
+
+// *******************************
+// Close a session
+// *******************************
+func (store *UserStore) logout(token string) {
+  store.mutex.Lock()
+  defer store.mutex.Unlock()
+  delete(store.sessions, token)
+}
+
+
+// *******************************
+// User logged in for this request, nil without authentication
+// *******************************
+func currentUser(r *http.Request) *UserAccount {
+  user, _ := r.Context().Value(userCtxKey).(*UserAccount)
+  return user
+}
+
+
+// *******************************
+// Only let requests with a valid session through,
+// others are sent to the login page
+// *******************************
+func (store *UserStore) requireLogin(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/login" || strings.HasPrefix(r.URL.Path, "/assets/") {
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    cookie, err := r.Cookie(sessionCookieName)
+    if err != nil {
+      http.Redirect(w, r, "/login", http.StatusSeeOther)
+      return
+    }
+    user := store.sessionUser(cookie.Value)
+    if user == nil {
+      http.Redirect(w, r, "/login", http.StatusSeeOther)
+      return
+    }
+
+    ctx := context.WithValue(r.Context(), userCtxKey, user)
+    next.ServeHTTP(w, r.WithContext(ctx))
+  })
+}
+
+
+// *******************************
+// Login form. Accounts are never created here, the first one
+// comes from the command line
+// *******************************
+func (store *UserStore) loginHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    data := struct {
+      NoUsers  bool
+      Error    string
+    }{NoUsers: len(store.Users) == 0}
+
+    if r.Method == http.MethodPost {
+      name := strings.TrimSpace(r.FormValue("user"))
+      password := r.FormValue("password")
+
+      token, err := store.login(name, password)
+      if err == nil {
+        http.SetCookie(w, &http.Cookie{
+          Name: sessionCookieName,
+          Value: token,
+          Path: "/",
+          Expires: time.Now().Add(sessionDuration),
+          HttpOnly: true,
+          SameSite: http.SameSiteStrictMode,
+        })
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+        return
+      }
+      data.Error = err.Error()
+    }
+
+    if err := loginTpl.Execute(w, data); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
+
+
+// *******************************
+// Close the session of the user
+// *******************************
+func (store *UserStore) logoutHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if cookie, err := r.Cookie(sessionCookieName); err == nil {
+      store.logout(cookie.Value)
+    }
+    http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+    http.Redirect(w, r, "/login", http.StatusSeeOther)
+  }
+}
+
+
+// *******************************
+// Add an account from form, only for admins
+// *******************************
+func (store *UserStore) addUserHandler(doc *Document) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSpace(r.FormValue("newUser"))
+    payer := strings.TrimSpace(r.FormValue("newUserPayer"))
+
+    if user := currentUser(r); user == nil || !user.Admin {
+      doc.addNotice("Only administrators can create accounts")
+    } else if err := store.addUser(name, r.FormValue("newUserPassword"), payer, false); err != nil {
+      doc.addNotice(err.Error())
+    } else {
+      doc.addNotice(fmt.Sprintf("User %s created", name))
+    }
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Command line: apunta adduser [-admin] [-payer name] user
+// The password is read from the first line of the input, so the
+// first account is never created from the network
+// *******************************
+func runAddUser(args []string, input io.Reader) int {
+  flags := flag.NewFlagSet("adduser", flag.ContinueOnError)
+  admin := flags.Bool("admin", false, "Let the account create other accounts")
+  payer := flags.String("payer", "", "Participant linked to the account")
+  if err := flags.Parse(args); err != nil {
+    return 1
+  }
+  if flags.NArg() != 1 {
+    fmt.Println("Usage: apunta adduser [-admin] [-payer name] user < password")
+    return 1
+  }
+
+  store, err := loadUserStore(usersFilePath())
+  if err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  fmt.Print("Password: ")
+  password, err := bufio.NewReader(input).ReadString('\n')
+  if err != nil && err != io.EOF {
+    fmt.Println(err)
+    return 1
+  }
+  password = strings.TrimRight(password, "\r\n")
+
+  if err := store.addUser(flags.Arg(0), password, *payer, *admin); err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  fmt.Printf("\nUser %s created in %s\n", flags.Arg(0), store.path)
+  return 0
+}
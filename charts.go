@@ -0,0 +1,263 @@
+package main
+
+import (
+  "fmt"
+  "html/template"
+  "math"
+  "net/http"
+  "sort"
+  "strings"
+)
+
+const (
+  chartWidth  = 420
+  chartHeight = 240
+)
+
+// Colors used in turns by the chart series
+var chartPalette = []string{
+  "#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f",
+  "#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac",
+}
+
+
+// *******************************
+// Spending in EUR per category for this month, net of refunds
+// *******************************
+func (month *MonthRec) categoryTotals(rateMode string) map[string]float64 {
+  totals := map[string]float64{}
+  for _, entry := range month.EntryRecords {
+    if entry.isSpending() {
+      totals[entry.Category] += entry.signedAmount() * month.entryRate(entry, rateMode)
+    }
+  }
+  return totals
+}
+
+
+// *******************************
+// Keys of a map of totals in alphabetical order
+// *******************************
+func sortedKeys(totals map[string]float64) []string {
+  keys := make([]string, 0, len(totals))
+  for key := range totals {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+
+// *******************************
+// Escape text to be placed inside SVG elements
+// *******************************
+func svgText(text string) string {
+  return template.HTMLEscapeString(text)
+}
+
+
+// *******************************
+// Open an SVG document of the chart size
+// *******************************
+func svgOpen(sb *strings.Builder, title string) {
+  fmt.Fprintf(sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+    chartWidth, chartHeight, chartWidth, chartHeight)
+  fmt.Fprintf(sb, `<rect width="100%%" height="100%%" fill="#ffffff"/><text x="10" y="16" font-size="13">%s</text>`, svgText(title))
+}
+
+
+// *******************************
+// Pie chart of the spending per category
+// *******************************
+func categoryPieSVG(month *MonthRec, rateMode string) string {
+  totals := month.categoryTotals(rateMode)
+  sum := 0.0
+  for _, value := range totals {
+    if value > 0 {
+      sum += value
+    }
+  }
+
+  var sb strings.Builder
+  svgOpen(&sb, "Spending per category: " + month.GroupName)
+  if sum <= 0 {
+    sb.WriteString(`<text x="10" y="40">No spending</text></svg>`)
+    return sb.String()
+  }
+
+  cx, cy, radius := 110.0, 130.0, 95.0
+  angle := -math.Pi / 2
+  for index, category := range sortedKeys(totals) {
+    value := totals[category]
+    if value <= 0 {
+      continue
+    }
+    color := chartPalette[index % len(chartPalette)]
+    fraction := value / sum
+
+    if fraction >= 1.0 {
+      fmt.Fprintf(&sb, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"/>`, cx, cy, radius, color)
+    } else {
+      endAngle := angle + 2 * math.Pi * fraction
+      largeArc := 0
+      if fraction > 0.5 {
+        largeArc = 1
+      }
+      fmt.Fprintf(&sb, `<path d="M %.1f %.1f L %.2f %.2f A %.1f %.1f 0 %d 1 %.2f %.2f Z" fill="%s"/>`,
+        cx, cy, cx + radius * math.Cos(angle), cy + radius * math.Sin(angle),
+        radius, radius, largeArc, cx + radius * math.Cos(endAngle), cy + radius * math.Sin(endAngle), color)
+      angle = endAngle
+    }
+
+    legendY := 40 + 16 * index
+    fmt.Fprintf(&sb, `<rect x="230" y="%d" width="10" height="10" fill="%s"/><text x="245" y="%d">%s %.2f (%.0f%%)</text>`,
+      legendY, color, legendY + 9, svgText(category), value, 100 * fraction)
+  }
+  sb.WriteString(`</svg>`)
+  return sb.String()
+}
+
+
+// *******************************
+// Horizontal bars of the debt of every payer
+// *******************************
+func payerBalanceSVG(month *MonthRec) string {
+  names := make([]string, 0, len(month.Stats.AllPayersStats))
+  maxValue := 0.0
+  for name, stats := range month.Stats.AllPayersStats {
+    names = append(names, name)
+    maxValue = math.Max(maxValue, math.Abs(stats.Debt))
+  }
+  sort.Strings(names)
+
+  var sb strings.Builder
+  svgOpen(&sb, "Debt per payer: " + month.GroupName)
+  if len(names) == 0 {
+    sb.WriteString(`<text x="10" y="40">No payers</text></svg>`)
+    return sb.String()
+  }
+
+  barArea := float64(chartWidth - 200)
+  barHeight := math.Min(24, float64(chartHeight - 40) / float64(len(names)) - 4)
+  for index, name := range names {
+    debt := month.Stats.AllPayersStats[name].Debt
+    width := 0.0
+    if maxValue > 0 {
+      width = barArea * math.Abs(debt) / maxValue
+    }
+    y := 30 + float64(index) * (barHeight + 4)
+    fmt.Fprintf(&sb, `<text x="10" y="%.1f">%s</text>`, y + barHeight / 2 + 4, svgText(name))
+    fmt.Fprintf(&sb, `<rect x="110" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`,
+      y, width, barHeight, chartPalette[index % len(chartPalette)])
+    fmt.Fprintf(&sb, `<text x="%.1f" y="%.1f">%.2f</text>`, 115 + width, y + barHeight / 2 + 4, debt)
+  }
+  sb.WriteString(`</svg>`)
+  return sb.String()
+}
+
+
+// *******************************
+// Line of the total spending of every month
+// *******************************
+func spendingTrendSVG(doc *Document) string {
+  totals := make([]float64, len(doc.MonthRecs))
+  maxValue := 0.0
+  for index := range doc.MonthRecs {
+    for _, value := range doc.MonthRecs[index].categoryTotals(doc.RateMode) {
+      totals[index] += value
+    }
+    maxValue = math.Max(maxValue, totals[index])
+  }
+
+  var sb strings.Builder
+  svgOpen(&sb, "Spending per month")
+  if len(totals) == 0 || maxValue <= 0 {
+    sb.WriteString(`<text x="10" y="40">No spending</text></svg>`)
+    return sb.String()
+  }
+
+  left, top := 50.0, 30.0
+  plotWidth, plotHeight := float64(chartWidth) - left - 20, float64(chartHeight) - top - 40
+  step := 0.0
+  if len(totals) > 1 {
+    step = plotWidth / float64(len(totals) - 1)
+  }
+
+  fmt.Fprintf(&sb, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#444"/>`, left, top + plotHeight, left + plotWidth, top + plotHeight)
+  fmt.Fprintf(&sb, `<text x="5" y="%.1f">%.0f</text><text x="5" y="%.1f">0</text>`, top + 4, maxValue, top + plotHeight)
+
+  points := make([]string, len(totals))
+  for index, total := range totals {
+    x := left + step * float64(index)
+    y := top + plotHeight * (1 - total / maxValue)
+    points[index] = fmt.Sprintf("%.1f,%.1f", x, y)
+    fmt.Fprintf(&sb, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %.2f</title></circle>`,
+      x, y, chartPalette[0], svgText(doc.MonthRecs[index].GroupName), total)
+    fmt.Fprintf(&sb, `<text x="%.1f" y="%.1f" font-size="9" text-anchor="middle">%s</text>`,
+      x, top + plotHeight + 14, svgText(doc.MonthRecs[index].GroupName))
+  }
+  fmt.Fprintf(&sb, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), chartPalette[0])
+  sb.WriteString(`</svg>`)
+  return sb.String()
+}
+
+
+// *******************************
+// Charts embedded in the page, used by the template
+// *******************************
+func (month *MonthRec) CategoryPie(rateMode string) template.HTML {
+  return template.HTML(categoryPieSVG(month, rateMode))
+}
+
+func (month *MonthRec) PayerBars() template.HTML {
+  return template.HTML(payerBalanceSVG(month))
+}
+
+func (doc *Document) SpendingTrend() template.HTML {
+  return template.HTML(spendingTrendSVG(doc))
+}
+
+
+// *******************************
+// Download a chart as an SVG file
+// ?type=pie|bars&sheet=<name> or ?type=trend
+// *******************************
+func (doc *Document) chartHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    chartType := r.FormValue("type")
+    sheetName := r.FormValue("sheet")
+
+    // Charts show the totals after the last edits
+    doc.calcAllStats()
+
+    var svg string
+    if chartType == "trend" {
+      svg = spendingTrendSVG(doc)
+    } else {
+      var month *MonthRec
+      for index := range doc.MonthRecs {
+        if doc.MonthRecs[index].GroupName == sheetName {
+          month = &doc.MonthRecs[index]
+        }
+      }
+      if month == nil {
+        http.Error(w, "Sheet " + sheetName + " not found", http.StatusNotFound)
+        return
+      }
+
+      switch chartType {
+      case "pie":
+        svg = categoryPieSVG(month, doc.RateMode)
+      case "bars":
+        svg = payerBalanceSVG(month)
+      default:
+        http.Error(w, "Unknown chart type " + chartType, http.StatusBadRequest)
+        return
+      }
+    }
+
+    w.Header().Set("Content-Type", "image/svg+xml")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"apunta_%s.svg\"", chartType))
+    fmt.Fprint(w, svg)
+  }
+}
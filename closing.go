@@ -0,0 +1,125 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+  "time"
+)
+
+
+// *******************************
+// Index of the last closed month, -1 if none
+// Closed months are always the first ones of the document
+// *******************************
+func (doc *Document) lastClosedIndex() int {
+  last := -1
+  for index, month := range doc.MonthRecs {
+    if month.Closed {
+      last = index
+    }
+  }
+  return last
+}
+
+
+// *******************************
+// First closed month using a payer or group in its entries or
+// statistics, whose frozen totals a change of them would alter
+// *******************************
+func (doc *Document) closedMonthUsing(payer, group string) (string, bool) {
+  for index := 0; index <= doc.lastClosedIndex(); index++ {
+    month := &doc.MonthRecs[index]
+    if _, ok := month.Stats.AllPayersStats[payer]; ok && payer != "" {
+      return month.GroupName, true
+    }
+    for _, entry := range month.EntryRecords {
+      if (payer != "" && entry.PersonName == payer) || (group != "" && entry.SharedGroup == group) {
+        return month.GroupName, true
+      }
+    }
+  }
+  return "", false
+}
+
+
+// *******************************
+// Check that a new sheet does not start within or before closed months
+// *******************************
+func (doc *Document) checkOpenPeriod(startDate time.Time) error {
+  if last := doc.lastClosedIndex(); last >= 0 {
+    closedEnd := doc.MonthRecs[last].PeriodEnd()
+    if !dayOf(startDate).After(dayOf(closedEnd)) {
+      return fmt.Errorf("Date %s is within closed months, until %s",
+        startDate.Format("2006-01-02"), closedEnd.Format("2006-01-02"))
+    }
+  }
+  return nil
+}
+
+
+// *******************************
+// Close a month: its statistics and exchange rates are frozen
+// and its entries can not be edited anymore
+// *******************************
+func (doc *Document) closeMonth(name string) error {
+  doc.sortMonthsByDate()
+  doc.calcAllStats()
+
+  for index := range doc.MonthRecs {
+    month := &doc.MonthRecs[index]
+    if month.GroupName != name {
+      if !month.Closed {
+        return fmt.Errorf("Month %s must be closed before %s", month.GroupName, name)
+      }
+      continue
+    }
+    if month.Closed {
+      return fmt.Errorf("Month %s is already closed", name)
+    }
+
+    month.Closed = true
+    month.ClosedDate = time.Now()
+    return nil
+  }
+  return fmt.Errorf("Month %s does not exist", name)
+}
+
+
+// *******************************
+// Reopen the last closed month
+// *******************************
+func (doc *Document) reopenMonth(name string) error {
+  last := doc.lastClosedIndex()
+  if last < 0 || doc.MonthRecs[last].GroupName != name {
+    return fmt.Errorf("Only the last closed month can be reopened")
+  }
+
+  doc.MonthRecs[last].Closed = false
+  doc.MonthRecs[last].ClosedDate = time.Time{}
+  doc.invalidateStats(last)
+  doc.calcAllStats()
+  return nil
+}
+
+
+// *******************************
+// Close or reopen month from form
+// *******************************
+func (doc *Document) closeMonthHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSpace(r.FormValue("closeSheet"))
+
+    var err error
+    if r.FormValue("reopen") != "" {
+      err = doc.reopenMonth(name)
+    } else {
+      err = doc.closeMonth(name)
+    }
+    if err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.render(w, r)
+  }
+}
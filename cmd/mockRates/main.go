@@ -0,0 +1,26 @@
+// Run the stand-in exchange rate server for demos without network:
+//
+//	go run ./cmd/mockRates 8081
+//	export OPEN_EXCHANGE_URL=http://localhost:8081/api
+//	export ECB_RATES_URL=http://localhost:8081/ecb
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"apunta/exchRates/mockRates"
+)
+
+func main() {
+	port := "8081"
+	if len(os.Args) == 2 {
+		port = os.Args[1]
+	}
+
+	fmt.Println("Serving fixture exchange rates on localhost:" + port)
+	if err := http.ListenAndServe("localhost:"+port, mockRates.NewServer()); err != nil {
+		fmt.Println(err)
+	}
+}
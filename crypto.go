@@ -0,0 +1,237 @@
+package main
+
+import (
+  "bytes"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+
+  "golang.org/x/crypto/scrypt"
+)
+
+const (
+  encryptedFormat = "apunta-encrypted-v1"
+  passphraseEnv   = "APUNTA_PASSPHRASE"
+  saltSize        = 16
+)
+
+// Parameters of the scrypt key derivation, lowered in tests
+var (
+  scryptN = 1 << 15
+  scryptR = 8
+  scryptP = 1
+)
+
+// Limits of the parameters read from a file, so a crafted file can't
+// use all the memory or CPU. scrypt uses 128 * N * R bytes
+const (
+  scryptMinN      = 1 << 10
+  scryptMaxN      = 1 << 20
+  scryptMaxR      = 16
+  scryptMaxP      = 4
+  scryptMaxMemory = 256 << 20
+)
+
+var (
+  ErrNoPassphrase    = errors.New("document is encrypted: set " + passphraseEnv)
+  ErrWrongPassphrase = errors.New("wrong passphrase or corrupted document")
+)
+
+// Document file encrypted with AES-256-GCM and a key derived from a passphrase
+type encryptedFile struct {
+  Format      string
+  KDF         string
+  N           int
+  R           int
+  P           int
+  Salt        []byte
+  Nonce       []byte
+  Ciphertext  []byte
+}
+
+
+// *******************************
+// Check if the file content is an encrypted document
+// *******************************
+func isEncrypted(data []byte) bool {
+  if !bytes.Contains(data, []byte(encryptedFormat)) {
+    return false
+  }
+  var file encryptedFile
+  if err := json.Unmarshal(data, &file); err != nil {
+    return false
+  }
+  return file.Format == encryptedFormat
+}
+
+
+// *******************************
+// Check the key derivation parameters of a file before using them
+// *******************************
+func checkScryptParams(n, r, p int) error {
+  if n < scryptMinN || n > scryptMaxN || n & (n - 1) != 0 {
+    return fmt.Errorf("invalid scrypt parameter N=%d", n)
+  }
+  if r < 1 || r > scryptMaxR || p < 1 || p > scryptMaxP {
+    return fmt.Errorf("invalid scrypt parameters r=%d p=%d", r, p)
+  }
+  if 128 * n * r > scryptMaxMemory {
+    return fmt.Errorf("scrypt parameters N=%d r=%d use too much memory", n, r)
+  }
+  return nil
+}
+
+
+// *******************************
+// Cipher for the passphrase with the given key derivation parameters
+// *******************************
+func newGCM(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+  key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+  if err != nil {
+    return nil, err
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  return cipher.NewGCM(block)
+}
+
+
+// *******************************
+// Encrypt the plain document with a fresh salt and nonce
+// *******************************
+func encryptDocument(plain []byte, passphrase string) ([]byte, error) {
+  if passphrase == "" {
+    return nil, ErrNoPassphrase
+  }
+  file := encryptedFile{Format: encryptedFormat, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP}
+  file.Salt = make([]byte, saltSize)
+  if _, err := rand.Read(file.Salt); err != nil {
+    return nil, err
+  }
+  gcm, err := newGCM(passphrase, file.Salt, file.N, file.R, file.P)
+  if err != nil {
+    return nil, err
+  }
+  file.Nonce = make([]byte, gcm.NonceSize())
+  if _, err := rand.Read(file.Nonce); err != nil {
+    return nil, err
+  }
+  // The format name is authenticated too, so the header can't be swapped
+  file.Ciphertext = gcm.Seal(nil, file.Nonce, plain, []byte(file.Format))
+  return json.MarshalIndent(file, "", " ")
+}
+
+
+// *******************************
+// Decrypt an encrypted document, failing if it was modified
+// *******************************
+func decryptDocument(data []byte, passphrase string) ([]byte, error) {
+  var file encryptedFile
+  if err := json.Unmarshal(data, &file); err != nil {
+    return nil, err
+  }
+  if file.Format != encryptedFormat || file.KDF != "scrypt" {
+    return nil, fmt.Errorf("unknown encrypted format %q", file.Format)
+  }
+  if passphrase == "" {
+    return nil, ErrNoPassphrase
+  }
+  if err := checkScryptParams(file.N, file.R, file.P); err != nil {
+    return nil, err
+  }
+  if len(file.Salt) != saltSize {
+    return nil, fmt.Errorf("invalid salt size %d", len(file.Salt))
+  }
+  gcm, err := newGCM(passphrase, file.Salt, file.N, file.R, file.P)
+  if err != nil {
+    return nil, err
+  }
+  if len(file.Nonce) != gcm.NonceSize() {
+    return nil, ErrWrongPassphrase
+  }
+  plain, err := gcm.Open(nil, file.Nonce, file.Ciphertext, []byte(file.Format))
+  if err != nil {
+    return nil, ErrWrongPassphrase
+  }
+  return plain, nil
+}
+
+
+// *******************************
+// Read a document file, decrypting it if needed
+// *******************************
+func loadDocument(path string, passphrase string) (*Document, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return decodeDocument(data, passphrase)
+}
+
+
+// *******************************
+// Document from the content of a file, decrypting it if needed
+// *******************************
+func decodeDocument(data []byte, passphrase string) (*Document, error) {
+  doc := newDocument()
+  if isEncrypted(data) {
+    var err error
+    data, err = decryptDocument(data, passphrase)
+    if err != nil {
+      return nil, err
+    }
+    doc.passphrase = passphrase
+  }
+  // Files written before versions existed have no Version key
+  doc.Version = 0
+  if err := json.Unmarshal(data, doc); err != nil {
+    return nil, err
+  }
+  doc.migrate()
+  doc.sortMonthsByDate()
+  return doc, nil
+}
+
+
+// *******************************
+// File content of the document, encrypted when it has a passphrase
+// *******************************
+func (doc *Document) encode() ([]byte, error) {
+  b, err := json.MarshalIndent(doc, "", " ")
+  if err != nil {
+    return nil, err
+  }
+  if doc.passphrase == "" {
+    return b, nil
+  }
+  return encryptDocument(b, doc.passphrase)
+}
+
+
+// *******************************
+// Write the document file, readable only by the owner when encrypted
+// *******************************
+func (doc *Document) save(path string) error {
+  b, err := doc.encode()
+  if err != nil {
+    return err
+  }
+  if doc.passphrase != "" {
+    // Receipts added before the passphrase was set
+    if err := doc.encryptAttachments(attachmentsDirOf(path)); err != nil {
+      return err
+    }
+  }
+  mode := os.FileMode(0644)
+  if doc.passphrase != "" {
+    mode = 0600
+  }
+  return ioutil.WriteFile(path, b, mode)
+}
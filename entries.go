@@ -0,0 +1,124 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "fmt"
+  "sort"
+)
+
+const (
+  // Kinds of entries, expenses are the default
+  kindExpense = ""
+  kindIncome  = "income"
+  kindRefund  = "refund"
+
+  // Number of past expenses offered to be refunded
+  refundableEntries = 50
+)
+
+
+// *******************************
+// Create a random identifier for a new entry
+// *******************************
+func newEntryID() string {
+  b := make([]byte, 8)
+  if _, err := rand.Read(b); err != nil {
+    fmt.Println(err)
+  }
+  return hex.EncodeToString(b)
+}
+
+
+// *******************************
+// Amount with the sign of its effect in the spending:
+// expenses add, income and refunds subtract
+// *******************************
+func (entry EntryRec) signedAmount() float64 {
+  if entry.Kind == kindIncome || entry.Kind == kindRefund {
+    return -entry.Amount
+  }
+  return entry.Amount
+}
+
+
+// *******************************
+// Check if the entry counts as spending, refunds included
+// *******************************
+func (entry EntryRec) isSpending() bool {
+  return entry.Kind != kindIncome
+}
+
+
+// *******************************
+// Spending in EUR of the month, net of refunds
+// *******************************
+func (month *MonthRec) Expenses(rateMode string) float64 {
+  total := 0.0
+  for _, entry := range month.EntryRecords {
+    if entry.isSpending() {
+      total += entry.signedAmount() * month.entryRate(entry, rateMode)
+    }
+  }
+  return total
+}
+
+
+// *******************************
+// Income in EUR of the month
+// *******************************
+func (month *MonthRec) Income(rateMode string) float64 {
+  total := 0.0
+  for _, entry := range month.EntryRecords {
+    if !entry.isSpending() {
+      total += entry.Amount * month.entryRate(entry, rateMode)
+    }
+  }
+  return total
+}
+
+
+// *******************************
+// Income minus spending of the month
+// *******************************
+func (month *MonthRec) Net(rateMode string) float64 {
+  return month.Income(rateMode) - month.Expenses(rateMode)
+}
+
+
+// *******************************
+// Find an entry by its identifier in all months
+// *******************************
+func (doc *Document) findEntry(id string) (*EntryRec, bool) {
+  for monthIdx := range doc.MonthRecs {
+    for entryIdx := range doc.MonthRecs[monthIdx].EntryRecords {
+      if doc.MonthRecs[monthIdx].EntryRecords[entryIdx].ID == id {
+        return &doc.MonthRecs[monthIdx].EntryRecords[entryIdx], true
+      }
+    }
+  }
+  return nil, false
+}
+
+
+// *******************************
+// Latest expenses that can be refunded, used by the template
+// *******************************
+func (doc *Document) RefundableEntries() []EntryRec {
+  expenses := make([]EntryRec, 0)
+  for _, month := range doc.MonthRecs {
+    for _, entry := range month.EntryRecords {
+      if entry.Kind == kindExpense && entry.ID != "" {
+        expenses = append(expenses, entry)
+      }
+    }
+  }
+
+  sort.SliceStable(expenses, func(i, j int) bool {
+    return expenses[i].Date.After(expenses[j].Date)
+  })
+  if len(expenses) > refundableEntries {
+    expenses = expenses[:refundableEntries]
+  }
+  return expenses
+}
@@ -0,0 +1,42 @@
+package exchRates
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of failures getting a rate, to be checked with errors.Is
+var (
+	ErrUnsupportedCurrency = errors.New("Unsupported currency")
+	ErrMissingCredentials  = errors.New("Missing or invalid credentials")
+	ErrNetwork             = errors.New("Network error")
+	ErrQuotaExceeded       = errors.New("Quota exceeded")
+	ErrBadPayload          = errors.New("Bad payload")
+)
+
+// Failure getting the rate between two currencies on a date
+type RateError struct {
+	From  string
+	To    string
+	Date  time.Time
+	Kind  error
+	Cause error
+}
+
+func (e *RateError) Error() string {
+	msg := fmt.Sprintf("%s getting rate %s->%s on %s", e.Kind, e.From, e.To, e.Date.Format("2006-01-02"))
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *RateError) Unwrap() error {
+	return e.Kind
+}
+
+// Only network failures and server errors are worth retrying
+func isTemporary(err error) bool {
+	return errors.Is(err, ErrNetwork)
+}
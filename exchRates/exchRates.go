@@ -1,55 +1,283 @@
 package exchRates
 
 import (
-  "fmt"
-  "net/http"
-  "encoding/json"
-  "io/ioutil"
-  "os"
-  "time"
-  "errors"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBaseURL = "https://openexchangerates.org/api"
+	defaultECBURL  = "https://www.ecb.europa.eu/stats/eurofxref"
+)
+
+var (
+	// Base URL of the rate service, OPEN_EXCHANGE_URL overrides it
+	baseURL = defaultBaseURL
+	// Base URL of the ECB reference rates, ECB_RATES_URL overrides it
+	ecbURL = defaultECBURL
+
+	// Client used for all requests, with a timeout per request
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+	// Attempts for temporary failures, waiting twice as long every time
+	retryAttempts = 3
+	retryBackoff  = 500 * time.Millisecond
 )
 
 type exchangeData struct {
-	Disclaimer string `json:"disclaimer"`
-	License    string `json:"license"`
-	Timestamp  int    `json:"timestamp"`
-	Base       string `json:"base"`
-	Rates      struct {
-		Chf float64 `json:"CHF"`
-		Eur float64 `json:"EUR"`
-	} `json:"rates"`
+	Disclaimer  string             `json:"disclaimer"`
+	License     string             `json:"license"`
+	Timestamp   int                `json:"timestamp"`
+	Base        string             `json:"base"`
+	Rates       map[string]float64 `json:"rates"`
+	Error       bool               `json:"error"`
+	Message     string             `json:"message"`
+	Description string             `json:"description"`
 }
 
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string  `xml:"currency,attr"`
+			Rate     float64 `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// Parsed ECB history, downloaded once a day as it holds all the dates
+var ecbCache struct {
+	sync.Mutex
+	url      string
+	day      string
+	envelope *ecbEnvelope
+}
+
+// Set the base URL of the openexchangerates compatible service
+func SetBaseURL(url string) {
+	baseURL = url
+}
+
+// Set the base URL of the ECB compatible service
+func SetECBURL(url string) {
+	ecbURL = url
+}
+
+func serviceURLs() (string, string) {
+	oeURL, ecb := baseURL, ecbURL
+	if envURL := os.Getenv("OPEN_EXCHANGE_URL"); envURL != "" {
+		oeURL = envURL
+	}
+	if envURL := os.Getenv("ECB_RATES_URL"); envURL != "" {
+		ecb = envURL
+	}
+	return oeURL, ecb
+}
+
+// Get the rate to convert from one currency to another on a date
+// EXCHANGE_RATE_PROVIDER=ecb uses the ECB reference rates instead
+// of openexchangerates.org
+// On failure 1.0 is returned with a *RateError
 func GetRate(from, to string, date time.Time) (float64, error) {
+	var rate float64
+	var err error
+
+	wait := retryBackoff
+	for attempt := 1; attempt <= retryAttempts; attempt++ {
+		if os.Getenv("EXCHANGE_RATE_PROVIDER") == "ecb" {
+			rate, err = getECBRate(from, to, date)
+		} else {
+			rate, err = getOpenExchangeRate(from, to, date)
+		}
+		if err == nil || !isTemporary(err) || attempt == retryAttempts {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
 
-	if from != "CHF" {
-		return 1.0, errors.New("Unsupported exchange rate. defaulting to 1.0 exchange rate")
+	if err != nil {
+		return 1.0, &RateError{From: from, To: to, Date: date, Kind: kindOf(err), Cause: causeOf(err)}
+	}
+	return rate, nil
+}
+
+// Internal failure, with its kind and underlying cause
+type failure struct {
+	kind  error
+	cause error
+}
+
+func (f *failure) Error() string {
+	if f.cause == nil {
+		return f.kind.Error()
 	}
+	return f.kind.Error() + ": " + f.cause.Error()
+}
 
+func (f *failure) Unwrap() error {
+	return f.kind
+}
+
+func fail(kind, cause error) error {
+	return &failure{kind, cause}
+}
+
+func kindOf(err error) error {
+	if f, ok := err.(*failure); ok {
+		return f.kind
+	}
+	return ErrNetwork
+}
+
+func causeOf(err error) error {
+	if f, ok := err.(*failure); ok {
+		return f.cause
+	}
+	return err
+}
+
+// Send a request and read the body, classifying the HTTP status
+func fetch(requestURL string) ([]byte, error) {
+	resp, err := httpClient.Get(requestURL)
+	if err != nil {
+		return nil, fail(ErrNetwork, withoutQuery(err))
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fail(ErrNetwork, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fail(ErrMissingCredentials, fmt.Errorf("HTTP status %d", resp.StatusCode))
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fail(ErrQuotaExceeded, fmt.Errorf("HTTP status %d", resp.StatusCode))
+	case resp.StatusCode >= 500:
+		return nil, fail(ErrNetwork, fmt.Errorf("HTTP status %d", resp.StatusCode))
+	default:
+		return nil, fail(ErrBadPayload, fmt.Errorf("HTTP status %d: %s", resp.StatusCode, body))
+	}
+}
+
+// Request errors quote the URL, whose query has the app id
+func withoutQuery(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	redacted := *urlErr
+	if parsed, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+		parsed.RawQuery = ""
+		redacted.URL = parsed.String()
+	} else {
+		redacted.URL = ""
+	}
+	return &redacted
+}
+
+// Get the rate from openexchangerates.org, based on USD
+func getOpenExchangeRate(from, to string, date time.Time) (float64, error) {
 	oeid := os.Getenv("OPEN_EXCHANGE_APP_ID")
 	if oeid == "" {
-		return 1.0, errors.New("No OPEN_EXCHANGE_APP_ID env variable found, defaulting to 1.0 exchange rate")
+		return 1.0, fail(ErrMissingCredentials, fmt.Errorf("No OPEN_EXCHANGE_APP_ID env variable found"))
 	}
+	oeURL, _ := serviceURLs()
 	symbols := fmt.Sprintf("%s,%s", from, to)
 	const url_date_layout string = "2006-01-02"
 	url_date := date.Format(url_date_layout)
-	urlRequest := fmt.Sprintf("https://openexchangerates.org/api/historical/%s.json?app_id=%s&symbols=%s",
-		url_date, oeid, symbols)
-	resp, err := http.Get(urlRequest)
+	urlRequest := fmt.Sprintf("%s/historical/%s.json?app_id=%s&symbols=%s",
+		oeURL, url_date, oeid, symbols)
+
+	body, err := fetch(urlRequest)
 	if err != nil {
-	   fmt.Println(err)
+		return 1.0, err
 	}
 
-	defer resp.Body.Close()
+	exData := &exchangeData{}
+	if err := json.Unmarshal(body, exData); err != nil {
+		return 1.0, fail(ErrBadPayload, err)
+	}
+	if exData.Error {
+		return 1.0, fail(ErrBadPayload, fmt.Errorf("%s: %s", exData.Message, exData.Description))
+	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	return crossRate(exData.Rates, from, to)
+}
+
+// Rate between two currencies given their rates to a common base
+func crossRate(rates map[string]float64, from, to string) (float64, error) {
+	fromRate, fromOk := rates[from]
+	toRate, toOk := rates[to]
+	if !fromOk || !toOk {
+		return 1.0, fail(ErrUnsupportedCurrency, fmt.Errorf("No rate for %s->%s", from, to))
+	}
+	if fromRate <= 0.0 || toRate <= 0.0 {
+		return 1.0, fail(ErrBadPayload, fmt.Errorf("Invalid rates %s=%f %s=%f", from, fromRate, to, toRate))
+	}
+	return toRate / fromRate, nil
+}
+
+// ECB history of all the dates, from the cache if fetched today
+// Concurrent callers wait for a single download
+func ecbHistory(historyURL string) (*ecbEnvelope, error) {
+	ecbCache.Lock()
+	defer ecbCache.Unlock()
+
+	today := time.Now().UTC().Format("2006-01-02")
+	if ecbCache.envelope != nil && ecbCache.url == historyURL && ecbCache.day == today {
+		return ecbCache.envelope, nil
+	}
+	body, err := fetch(historyURL)
 	if err != nil {
-	  fmt.Println(err)
+		return nil, err
 	}
+	envelope := &ecbEnvelope{}
+	if err := xml.Unmarshal(body, envelope); err != nil {
+		return nil, fail(ErrBadPayload, err)
+	}
+	ecbCache.url, ecbCache.day, ecbCache.envelope = historyURL, today, envelope
+	return envelope, nil
+}
 
-	exData := &exchangeData{}
-	json.Unmarshal(body, exData)
+// Get the rate from the ECB daily reference rates, based on EUR
+func getECBRate(from, to string, date time.Time) (float64, error) {
+	_, ecb := serviceURLs()
+	envelope, err := ecbHistory(ecb + "/eurofxref-hist.xml")
+	if err != nil {
+		return 1.0, err
+	}
 
-	return exData.Rates.Eur/exData.Rates.Chf, nil
-}
\ No newline at end of file
+	// Use the last published day not after the date, weekends have no rates
+	const ecb_date_layout string = "2006-01-02"
+	wanted := date.Format(ecb_date_layout)
+	best := ""
+	rates := map[string]float64{}
+	for _, day := range envelope.Days {
+		if day.Time > wanted || day.Time < best {
+			continue
+		}
+		best = day.Time
+		rates = map[string]float64{"EUR": 1.0}
+		for _, rate := range day.Rates {
+			rates[rate.Currency] = rate.Rate
+		}
+	}
+	if best == "" {
+		return 1.0, fail(ErrBadPayload, fmt.Errorf("No ECB rates published before %s", wanted))
+	}
+
+	return crossRate(rates, from, to)
+}
@@ -0,0 +1,175 @@
+package exchRates
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"apunta/exchRates/mockRates"
+)
+
+func startMockServer(t *testing.T) *mockRates.Server {
+	mock := mockRates.NewServer()
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+	t.Setenv("OPEN_EXCHANGE_URL", server.URL+"/api")
+	t.Setenv("ECB_RATES_URL", server.URL+"/ecb")
+	t.Setenv("OPEN_EXCHANGE_APP_ID", "test")
+	return mock
+}
+
+func TestGetRateOpenExchange(t *testing.T) {
+	startMockServer(t)
+
+	rate, err := GetRate("CHF", "EUR", time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 0.8315 / 0.9125; math.Abs(rate-expected) > 1e-9 {
+		t.Errorf("Expected rate %f, got %f", expected, rate)
+	}
+}
+
+func TestGetRateECB(t *testing.T) {
+	startMockServer(t)
+	t.Setenv("EXCHANGE_RATE_PROVIDER", "ecb")
+
+	// Saturday uses the rates of Friday
+	rate, err := GetRate("CHF", "EUR", time.Date(2021, time.Month(5), 8, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 0.8228 / 0.9012; math.Abs(rate-expected) > 1e-3 {
+		t.Errorf("Expected rate %f, got %f", expected, rate)
+	}
+}
+
+func TestGetRateECBDownloadsOnce(t *testing.T) {
+	mock := startMockServer(t)
+	t.Setenv("EXCHANGE_RATE_PROVIDER", "ecb")
+
+	date := time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC)
+	for _, curr := range []string{"CHF", "USD", "CHF"} {
+		if _, err := GetRate(curr, "EUR", date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := GetRate("CHF", "EUR", date.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if mock.Requests() != 1 {
+		t.Errorf("Expected the history downloaded once, got %d requests", mock.Requests())
+	}
+}
+
+func TestGetRateErrors(t *testing.T) {
+	mock := startMockServer(t)
+	mock.AppID = "secret"
+
+	date := time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC)
+	if rate, err := GetRate("CHF", "EUR", date); err == nil || rate != 1.0 {
+		t.Errorf("Expected error with wrong app id, got %f", rate)
+	}
+
+	mock.AppID = ""
+	if rate, err := GetRate("XXX", "EUR", date); err == nil || rate != 1.0 {
+		t.Errorf("Expected error with unknown currency, got %f", rate)
+	}
+	if rate, err := GetRate("CHF", "EUR", date.AddDate(1, 0, 0)); err == nil || rate != 1.0 {
+		t.Errorf("Expected error with date without rates, got %f", rate)
+	}
+
+	t.Setenv("OPEN_EXCHANGE_APP_ID", "")
+	if _, err := GetRate("CHF", "EUR", date); err == nil {
+		t.Errorf("Expected error without app id")
+	}
+}
+
+func TestGetRateTypedErrors(t *testing.T) {
+	mock := startMockServer(t)
+	date := time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		setup func()
+		kind  error
+	}{
+		{"unsupported currency", func() {}, ErrUnsupportedCurrency},
+		{"wrong app id", func() { mock.AppID = "secret" }, ErrMissingCredentials},
+		{"quota exceeded", func() { mock.QuotaExceeded = true }, ErrQuotaExceeded},
+		{"server down", func() { mock.FailNext = retryAttempts }, ErrNetwork},
+	}
+	for _, c := range cases {
+		mock.AppID, mock.QuotaExceeded, mock.FailNext = "", false, 0
+		c.setup()
+		from := "CHF"
+		if c.kind == ErrUnsupportedCurrency {
+			from = "XXX"
+		}
+
+		rate, err := GetRate(from, "EUR", date)
+		var rateErr *RateError
+		if !errors.As(err, &rateErr) || !errors.Is(err, c.kind) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.kind, err)
+		}
+		if rate != 1.0 {
+			t.Errorf("%s: expected 1.0 rate on failure, got %f", c.name, rate)
+		}
+	}
+}
+
+func TestGetRateRetries(t *testing.T) {
+	mock := startMockServer(t)
+	mock.FailNext = retryAttempts - 1
+
+	if _, err := GetRate("CHF", "EUR", time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("Temporary failures not retried: %v", err)
+	}
+	if mock.Requests() != retryAttempts {
+		t.Errorf("Expected %d requests, got %d", retryAttempts, mock.Requests())
+	}
+}
+
+func TestGetRateErrorHidesAppID(t *testing.T) {
+	startMockServer(t)
+	t.Setenv("OPEN_EXCHANGE_URL", "http://127.0.0.1:1/api")
+	t.Setenv("OPEN_EXCHANGE_APP_ID", "SECRETKEY123")
+
+	_, err := GetRate("CHF", "EUR", time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC))
+	if err == nil || !errors.Is(err, ErrNetwork) {
+		t.Fatalf("Expected network error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "SECRETKEY123") || !strings.Contains(err.Error(), "127.0.0.1:1") {
+		t.Errorf("Unexpected error text %q", err.Error())
+	}
+}
+
+func TestCrossRateZero(t *testing.T) {
+	if _, err := crossRate(map[string]float64{"CHF": 0.0, "EUR": 0.83}, "CHF", "EUR"); !errors.Is(err, ErrBadPayload) {
+		t.Errorf("Zero rate not rejected: %v", err)
+	}
+}
+
+func TestGetRateTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	t.Setenv("OPEN_EXCHANGE_URL", slow.URL)
+	t.Setenv("OPEN_EXCHANGE_APP_ID", "test")
+
+	client, attempts := httpClient, retryAttempts
+	httpClient, retryAttempts = &http.Client{Timeout: 20 * time.Millisecond}, 1
+	defer func() { httpClient, retryAttempts = client, attempts }()
+
+	if _, err := GetRate("CHF", "EUR", time.Now()); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected network error on timeout, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Local stand-in for the exchange rate services, serving fixture
+// data in the openexchangerates.org and ECB formats. Used by the
+// tests and to run demos without network access.
+package mockRates
+
+import (
+	_ "embed"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Rates per day, all based on USD
+//
+//go:embed fixtures.json
+var fixturesJSON []byte
+
+type Server struct {
+	// Rates per date, YYYY-MM-DD, against USD
+	Rates map[string]map[string]float64
+	// App id accepted by the openexchangerates endpoint, any if empty
+	AppID string
+	// Number of coming requests answered with 503 Service Unavailable
+	FailNext int
+	// Answer every request with 429 Too Many Requests
+	QuotaExceeded bool
+
+	mutex    sync.Mutex
+	requests int
+}
+
+// Create a stand-in server with the bundled fixtures
+func NewServer() *Server {
+	rates := map[string]map[string]float64{}
+	if err := json.Unmarshal(fixturesJSON, &rates); err != nil {
+		panic(err)
+	}
+	return &Server{Rates: rates}
+}
+
+// Number of requests served so far
+func (s *Server) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests++
+	failing := s.FailNext > 0
+	if failing {
+		s.FailNext--
+	}
+	s.mutex.Unlock()
+
+	if failing {
+		writeJSONError(w, http.StatusServiceUnavailable, "unavailable", "Service temporarily unavailable.")
+		return
+	}
+	if s.QuotaExceeded {
+		writeJSONError(w, http.StatusTooManyRequests, "too_many_requests", "Request quota exceeded.")
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/historical/"):
+		s.serveHistorical(w, r)
+	case r.URL.Path == "/ecb/eurofxref-hist.xml":
+		s.serveECB(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// openexchangerates.org historical endpoint
+// /api/historical/YYYY-MM-DD.json?app_id=...&symbols=A,B
+func (s *Server) serveHistorical(w http.ResponseWriter, r *http.Request) {
+	date := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/historical/"), ".json")
+
+	if s.AppID != "" && r.FormValue("app_id") != s.AppID {
+		writeJSONError(w, http.StatusUnauthorized, "invalid_app_id", "Invalid App ID provided.")
+		return
+	}
+	dayRates, ok := s.Rates[date]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "not_available", "Historical rates for the requested date are not available.")
+		return
+	}
+
+	rates := map[string]float64{}
+	if symbols := r.FormValue("symbols"); symbols != "" {
+		for _, symbol := range strings.Split(symbols, ",") {
+			if rate, ok := dayRates[symbol]; ok {
+				rates[symbol] = rate
+			}
+		}
+	} else {
+		rates = dayRates
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"disclaimer": "Fixture data for tests and demos",
+		"license":    "Fixture data for tests and demos",
+		"timestamp":  0,
+		"base":       "USD",
+		"rates":      rates,
+	})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       true,
+		"status":      status,
+		"message":     message,
+		"description": description,
+	})
+}
+
+type ecbRate struct {
+	Currency string `xml:"currency,attr"`
+	Rate     string `xml:"rate,attr"`
+}
+
+type ecbDay struct {
+	Time  string    `xml:"time,attr"`
+	Rates []ecbRate `xml:"Cube"`
+}
+
+type ecbEnvelope struct {
+	XMLName xml.Name `xml:"gesmes:Envelope"`
+	Gesmes  string   `xml:"xmlns:gesmes,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Subject string   `xml:"gesmes:subject"`
+	Days    []ecbDay `xml:"Cube>Cube"`
+}
+
+// ECB historical reference rates, based on EUR, newest day first
+func (s *Server) serveECB(w http.ResponseWriter, r *http.Request) {
+	dates := make([]string, 0, len(s.Rates))
+	for date := range s.Rates {
+		dates = append(dates, date)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+
+	envelope := ecbEnvelope{
+		Gesmes:  "http://www.gesmes.org/xml/2002-08-01",
+		Xmlns:   "http://www.ecb.int/vocabulary/2002-08-01/eurofxref",
+		Subject: "Reference rates",
+	}
+	for _, date := range dates {
+		dayRates := s.Rates[date]
+		eurRate, ok := dayRates["EUR"]
+		if !ok || eurRate == 0.0 {
+			continue
+		}
+
+		currencies := make([]string, 0, len(dayRates))
+		for currency := range dayRates {
+			if currency != "EUR" {
+				currencies = append(currencies, currency)
+			}
+		}
+		sort.Strings(currencies)
+
+		day := ecbDay{Time: date}
+		for _, currency := range currencies {
+			rate := fmt.Sprintf("%.4f", dayRates[currency]/eurRate)
+			day.Rates = append(day.Rates, ecbRate{currency, rate})
+		}
+		envelope.Days = append(envelope.Days, day)
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(envelope)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+  "fmt"
+  "html/template"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+var revisionsTpl = template.Must(template.ParseFiles("revisions.html"))
+
+// Document file committed to a local git repository on every save
+type gitStorage struct {
+  fileStorage
+  dir  string
+}
+
+// Commit of the document file
+type Revision struct {
+  Hash     string
+  Author   string
+  Time     time.Time
+  Message  string
+}
+
+
+// *******************************
+// Git storage for the file, creating the repository if the
+// directory is not the top of one
+// *******************************
+func newGitStorage(path string) (*gitStorage, error) {
+  store, err := openGitRepo(filepath.Dir(path))
+  if err != nil {
+    return nil, err
+  }
+  store.path = path
+  return store, nil
+}
+
+
+// *******************************
+// Repository of a directory, without document file
+// A repository of a parent directory belongs to another project,
+// so the directory gets its own one instead
+// *******************************
+func openGitRepo(dir string) (*gitStorage, error) {
+  store := &gitStorage{dir: dir}
+  if !store.isTopLevel() {
+    if _, err := store.git("init", "--quiet"); err != nil {
+      return nil, err
+    }
+  }
+  return store, nil
+}
+
+
+// *******************************
+// Check if the directory is the top of its repository
+// *******************************
+func (store *gitStorage) isTopLevel() bool {
+  out, err := store.git("rev-parse", "--show-toplevel")
+  if err != nil {
+    return false
+  }
+  top, err := filepath.EvalSymlinks(strings.TrimSpace(out))
+  if err != nil {
+    return false
+  }
+  dir, err := filepath.Abs(store.dir)
+  if err == nil {
+    dir, err = filepath.EvalSymlinks(dir)
+  }
+  return err == nil && filepath.Clean(top) == filepath.Clean(dir)
+}
+
+
+// *******************************
+// Run git in the directory of the document
+// *******************************
+func (store *gitStorage) git(args ...string) (string, error) {
+  cmd := exec.Command("git", append([]string{"-C", store.dir}, args...)...)
+  out, err := cmd.CombinedOutput()
+  if err != nil {
+    return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+  }
+  return string(out), nil
+}
+
+
+// *******************************
+// Check if a file is in the index or in the last commit
+// *******************************
+func (store *gitStorage) tracked(file string) bool {
+  if _, err := store.git("ls-files", "--error-unmatch", "--", file); err == nil {
+    return true
+  }
+  _, err := store.git("cat-file", "-e", "HEAD:./" + filepath.ToSlash(file))
+  return err == nil
+}
+
+
+// *******************************
+// Commit the given files, relative to the repository directory,
+// with an author and message. Missing files are committed as
+// deleted, and nothing is committed if the files did not change
+// *******************************
+func (store *gitStorage) commit(user, message string, files ...string) error {
+  var paths []string
+  for _, file := range files {
+    if _, err := os.Stat(filepath.Join(store.dir, file)); err == nil {
+      if _, err := store.git("add", "--", file); err != nil {
+        return err
+      }
+    } else if _, err := store.git("rm", "--cached", "--quiet", "--ignore-unmatch", "--", file); err != nil {
+      return err
+    }
+    if store.tracked(file) {
+      paths = append(paths, file)
+    }
+  }
+  if len(paths) == 0 {
+    return nil
+  }
+  args := append([]string{"diff", "--cached", "--quiet", "--"}, paths...)
+  if _, err := store.git(args...); err == nil {
+    return nil
+  }
+
+  if user == "" {
+    user = "apunta"
+  }
+  args = []string{"-c", "user.name=apunta", "-c", "user.email=apunta@localhost",
+    "commit", "--quiet", "--author", user + " <" + user + "@apunta>", "-m", message, "--"}
+  _, err := store.git(append(args, paths...)...)
+  return err
+}
+
+
+// *******************************
+// One line description of a change, for commit messages
+// Private ones only name the kind of change, as objects can be
+// payer names or form values
+// *******************************
+func describeEvent(event AuditEvent, private bool) string {
+  switch {
+  case private && event.Field != "":
+    return event.Action + ": " + event.Field
+  case private:
+    return event.Action
+  case event.Field != "":
+    return fmt.Sprintf("%s %s: %s %s -> %s", event.Action, event.Object, event.Field, event.Before, event.After)
+  case event.Before != "" && event.After != "" && event.Before != event.Object:
+    return fmt.Sprintf("%s %s: %s -> %s", event.Action, event.Object, event.Before, event.After)
+  case event.Before != "" && event.After != "":
+    return fmt.Sprintf("%s: %s -> %s", event.Action, event.Before, event.After)
+  case event.After != "":
+    return event.Action + ": " + event.After
+  case event.Before != "":
+    return event.Action + ": " + event.Before
+  }
+  return event.Action + ": " + event.Object
+}
+
+
+// *******************************
+// Commit message from the changes since the last save,
+// the first change is the subject and all are in the body
+// Values are left out of private messages, as those of
+// encrypted documents
+// *******************************
+func commitMessage(events []AuditEvent, private bool) string {
+  if len(events) == 0 {
+    return "save document"
+  }
+  subject := describeEvent(events[0], private)
+  if len(events) == 1 {
+    return subject
+  }
+  lines := []string{fmt.Sprintf("%s (and %d more changes)", subject, len(events) - 1), ""}
+  for _, event := range events {
+    line := describeEvent(event, private)
+    if event.User != "" {
+      line += " by " + event.User
+    }
+    lines = append(lines, "- " + line)
+  }
+  return strings.Join(lines, "\n")
+}
+
+
+// *******************************
+// Write the file and commit it with its receipts, described
+// by its changes
+// *******************************
+func (store *gitStorage) Save(doc *Document, user string) error {
+  if err := doc.save(store.path); err != nil {
+    return err
+  }
+  files := []string{filepath.Base(store.path)}
+  for _, name := range doc.attachmentNames() {
+    file, err := filepath.Rel(store.dir, filepath.Join(attachmentsDirOf(store.path), name))
+    if err != nil {
+      return err
+    }
+    files = append(files, file)
+  }
+  return store.commit(user, commitMessage(doc.unsavedAudit(), doc.passphrase != ""), files...)
+}
+
+
+// *******************************
+// Commit a document moved inside the repository
+// *******************************
+func (store *gitStorage) commitMove(user, from, to string) error {
+  fromRel, err := filepath.Rel(store.dir, from)
+  if err != nil {
+    return err
+  }
+  toRel, err := filepath.Rel(store.dir, to)
+  if err != nil {
+    return err
+  }
+  return store.commit(user, "move document " + fromRel + " to " + toRel, fromRel, toRel)
+}
+
+
+// *******************************
+// Commits of the document file, newest first
+// *******************************
+func (store *gitStorage) Revisions() ([]Revision, error) {
+  out, err := store.git("log", "--follow", "--format=%H%x1f%an%x1f%aI%x1f%s", "--", filepath.Base(store.path))
+  if err != nil {
+    // A repository without commits has no history yet
+    if _, headErr := store.git("rev-parse", "--verify", "--quiet", "HEAD"); headErr != nil {
+      return nil, nil
+    }
+    return nil, err
+  }
+
+  var revisions []Revision
+  for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+    fields := strings.Split(line, "\x1f")
+    if len(fields) != 4 {
+      continue
+    }
+    date, _ := time.Parse(time.RFC3339, fields[2])
+    revisions = append(revisions, Revision{Hash: fields[0], Author: fields[1], Time: date, Message: fields[3]})
+  }
+  return revisions, nil
+}
+
+
+// *******************************
+// Full message and changes of the document file in a commit
+// *******************************
+func (store *gitStorage) Show(hash string) (string, error) {
+  if !isHash(hash) {
+    return "", fmt.Errorf("Invalid revision %q", hash)
+  }
+  return store.git("show", "--format=medium", hash, "--", filepath.Base(store.path))
+}
+
+func isHash(hash string) bool {
+  if len(hash) < 7 || len(hash) > 40 {
+    return false
+  }
+  for _, c := range hash {
+    if !strings.ContainsRune("0123456789abcdef", c) {
+      return false
+    }
+  }
+  return true
+}
+
+
+// *******************************
+// Page with the commits of the document, and the
+// changes of the selected one
+// *******************************
+func (store *gitStorage) revisionsHandler(doc *Document) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    data := struct {
+      Doc        *Document
+      Revisions  []Revision
+      Selected   string
+      Changes    string
+      Error      string
+    }{Doc: doc, Selected: r.FormValue("hash")}
+
+    var err error
+    data.Revisions, err = store.Revisions()
+    if err == nil && data.Selected != "" {
+      data.Changes, err = store.Show(data.Selected)
+    }
+    if err != nil {
+      data.Error = err.Error()
+    }
+    if err := revisionsTpl.Execute(w, data); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
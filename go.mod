@@ -2,13 +2,17 @@ module apunta
 
 go 1.17
 
+require (
+	github.com/mattn/go-sqlite3 v1.14.19
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+)
+
 require (
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/richardlehane/mscfb v1.0.3 // indirect
 	github.com/richardlehane/msoleps v1.0.1 // indirect
 	github.com/xuri/efp v0.0.0-20210322160811-ab561f5b45e3 // indirect
 	github.com/xuri/excelize/v2 v2.4.1 // indirect
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
 	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
 	golang.org/x/text v0.3.6 // indirect
 )
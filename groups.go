@@ -0,0 +1,148 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+const (
+  // Name of the group created by default, shared between everybody
+  defaultGroupName = "All"
+)
+
+// A group of payers sharing an expense. Without members the
+// expense is split between all payers of the month
+type PayerGroup struct {
+  Name     string
+  Members  []string
+}
+
+
+// *******************************
+// Find a group by name
+// *******************************
+func (doc *Document) findGroup(name string) (int, bool) {
+  for index, group := range doc.Groups {
+    if group.Name == name {
+      return index, true
+    }
+  }
+  return -1, false
+}
+
+
+// *******************************
+// Add a group or update the members of an existing one
+// *******************************
+func (doc *Document) setGroup(name string, members []string) error {
+  if name == "" {
+    return fmt.Errorf("Group name can not be empty")
+  }
+  for _, member := range members {
+    if !doc.hasPayer(member) {
+      return fmt.Errorf("Group member %s is not a payer", member)
+    }
+  }
+
+  if index, ok := doc.findGroup(name); ok {
+    doc.Groups[index].Members = members
+  } else {
+    doc.Groups = append(doc.Groups, PayerGroup{name, members})
+  }
+  doc.invalidateAllStats()
+  return nil
+}
+
+
+// *******************************
+// Rename a group and all the entries shared with it
+// *******************************
+func (doc *Document) renameGroup(oldName, newName string) error {
+  if newName == "" {
+    return fmt.Errorf("Group name can not be empty")
+  }
+  index, ok := doc.findGroup(oldName)
+  if !ok {
+    return fmt.Errorf("Group %s does not exist", oldName)
+  }
+  if _, exists := doc.findGroup(newName); exists {
+    return fmt.Errorf("Group %s already exists", newName)
+  }
+  if month, ok := doc.closedMonthUsing("", oldName); ok {
+    return fmt.Errorf("Group %s is used in closed month %s, reopen it to rename the group", oldName, month)
+  }
+
+  doc.Groups[index].Name = newName
+  for monthIdx := range doc.MonthRecs {
+    for entryIdx, entry := range doc.MonthRecs[monthIdx].EntryRecords {
+      if entry.SharedGroup == oldName {
+        doc.MonthRecs[monthIdx].EntryRecords[entryIdx].SharedGroup = newName
+      }
+    }
+  }
+  for entryIdx := range doc.Inbox {
+    if doc.Inbox[entryIdx].SharedGroup == oldName {
+      doc.Inbox[entryIdx].SharedGroup = newName
+    }
+  }
+  for recIdx := range doc.Recurring {
+    if doc.Recurring[recIdx].SharedGroup == oldName {
+      doc.Recurring[recIdx].SharedGroup = newName
+    }
+  }
+  if doc.LastUsedGroup == oldName {
+    doc.LastUsedGroup = newName
+  }
+  return nil
+}
+
+
+// *******************************
+// Parse a comma separated list of names
+// *******************************
+func splitNames(names string) []string {
+  result := make([]string, 0)
+  for _, name := range strings.Split(names, ",") {
+    if name = strings.TrimSpace(name); name != "" {
+      result = append(result, name)
+    }
+  }
+  return result
+}
+
+
+// *******************************
+// Add group or update its members from form
+// *******************************
+func (doc *Document) addGroup() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    name := strings.TrimSpace(r.FormValue("groupName"))
+
+    if err := doc.setGroup(name, r.Form["groupMembers"]); err != nil {
+      fmt.Println(err)
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Rename group from form
+// *******************************
+func (doc *Document) renameGroupHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    oldName := strings.TrimSpace(r.FormValue("oldGroup"))
+    newName := strings.TrimSpace(r.FormValue("newGroupName"))
+
+    if err := doc.renameGroup(oldName, newName); err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.render(w, r)
+  }
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "html/template"
+  "net/http"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  opUndo = "undo"
+  opRedo = "redo"
+)
+
+var historyTpl = template.Must(template.ParseFiles("history.html"))
+
+// Change of one value in the JSON of the document, found by its path
+// of object keys and array indexes. Before is empty when the key was
+// added and After when it was removed. Arrays that change length are
+// changed by a splice at the index ending the path
+type Change struct {
+  Path     []string
+  Before   json.RawMessage   `json:",omitempty"`
+  After    json.RawMessage   `json:",omitempty"`
+  Splice   bool              `json:",omitempty"`
+  Removed  []json.RawMessage `json:",omitempty"`
+  Added    []json.RawMessage `json:",omitempty"`
+}
+
+// Change of the document made by a request, kept in an append-only log
+// saved with the document. Undo and redo are operations too, pointing
+// to the one they revert. Undone is rebuilt from the log
+type Operation struct {
+  Seq      int
+  Name     string
+  Params   string
+  User     string
+  Time     time.Time
+  Target   int
+  Undone   bool     `json:"-"`
+  Changes  []Change `json:",omitempty"`
+}
+
+// Operations that can be undone or redone, rebuilt from the log
+type History struct {
+  undo    []int
+  redo    []int
+}
+
+// Fields of the sheets only telling which one is shown. They are left
+// out of the changes, as requests that are not recorded change them
+var viewOnlyFields = []string{"ActiveGroup"}
+
+
+// *******************************
+// Undo state of the document, rebuilt from its log on first use
+// *******************************
+func (doc *Document) opHistory() *History {
+  if doc.history != nil {
+    return doc.history
+  }
+  history := &History{}
+  move := func(from, to *[]int, seq int, undone bool) {
+    if len(*from) > 0 {
+      *from = (*from)[:len(*from) - 1]
+    }
+    *to = append(*to, seq)
+    if seq > 0 && seq <= len(doc.Operations) {
+      doc.Operations[seq - 1].Undone = undone
+    }
+  }
+  for _, op := range doc.Operations {
+    switch op.Name {
+    case opUndo:
+      move(&history.undo, &history.redo, op.Target, true)
+    case opRedo:
+      move(&history.redo, &history.undo, op.Target, false)
+    default:
+      history.undo = append(history.undo, op.Seq)
+      history.redo = nil
+    }
+  }
+  doc.history = history
+  return history
+}
+
+
+// *******************************
+// Content of the document without the audit and operation
+// logs, which are never undone
+// *******************************
+func (doc *Document) snapshot() ([]byte, error) {
+  content := *doc
+  content.Audit = nil
+  content.Operations = nil
+  return json.Marshal(content)
+}
+
+
+// *******************************
+// Document of a snapshot, only used to compare its values
+// *******************************
+func fromSnapshot(snapshot []byte) (*Document, error) {
+  doc := &Document{}
+  err := json.Unmarshal(snapshot, doc)
+  return doc, err
+}
+
+
+// *******************************
+// Generic JSON value, numbers kept as written
+// *******************************
+func decodeTree(data []byte) (interface{}, error) {
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  var tree interface{}
+  err := decoder.Decode(&tree)
+  return tree, err
+}
+
+// Decoded values can always be encoded again
+func encodeTree(value interface{}) json.RawMessage {
+  data, _ := json.Marshal(value)
+  return data
+}
+
+func encodeTrees(values []interface{}) []json.RawMessage {
+  raws := make([]json.RawMessage, len(values))
+  for index, value := range values {
+    raws[index] = encodeTree(value)
+  }
+  return raws
+}
+
+func subPath(path []string, key string) []string {
+  return append(append([]string{}, path...), key)
+}
+
+
+// *******************************
+// Check if the path is in a view-only field of a sheet
+// *******************************
+func isViewOnly(path []string) bool {
+  return len(path) > 2 && path[0] == "MonthRecs" && containsStr(viewOnlyFields, path[2])
+}
+
+
+// *******************************
+// Sheets or sheet at the path without their view-only fields,
+// other values are returned as they are
+// *******************************
+func withoutViewOnly(path []string, value interface{}) interface{} {
+  if months, ok := value.([]interface{}); ok && len(path) == 1 && path[0] == "MonthRecs" {
+    stripped := make([]interface{}, len(months))
+    for index, month := range months {
+      stripped[index] = withoutViewOnly(subPath(path, strconv.Itoa(index)), month)
+    }
+    return stripped
+  }
+  month, ok := value.(map[string]interface{})
+  if !ok || len(path) != 2 || path[0] != "MonthRecs" {
+    return value
+  }
+  stripped := map[string]interface{}{}
+  for key, field := range month {
+    if !containsStr(viewOnlyFields, key) {
+      stripped[key] = field
+    }
+  }
+  return stripped
+}
+
+
+// *******************************
+// Check if a value is the one expected by a change, an empty
+// expected value means the key must be missing
+// *******************************
+func sameValue(path []string, expected json.RawMessage, value interface{}, present bool) (bool, error) {
+  if expected == nil || !present {
+    return expected == nil && !present, nil
+  }
+  tree, err := decodeTree(expected)
+  if err != nil {
+    return false, err
+  }
+  return reflect.DeepEqual(withoutViewOnly(path, tree), withoutViewOnly(path, value)), nil
+}
+
+
+// *******************************
+// Changes between two JSON values, added to the list
+// *******************************
+func diffTree(path []string, before, after interface{}, changes *[]Change) {
+  if reflect.DeepEqual(before, after) {
+    return
+  }
+  switch old := before.(type) {
+  case map[string]interface{}:
+    if new, ok := after.(map[string]interface{}); ok {
+      var keys []string
+      for key := range old {
+        keys = append(keys, key)
+      }
+      for key := range new {
+        if _, ok := old[key]; !ok {
+          keys = append(keys, key)
+        }
+      }
+      sort.Strings(keys)
+      for _, key := range keys {
+        if isViewOnly(subPath(path, key)) {
+          continue
+        }
+        oldValue, inOld := old[key]
+        newValue, inNew := new[key]
+        if inOld && inNew {
+          diffTree(subPath(path, key), oldValue, newValue, changes)
+          continue
+        }
+        change := Change{Path: subPath(path, key)}
+        if inOld {
+          change.Before = encodeTree(withoutViewOnly(change.Path, oldValue))
+        }
+        if inNew {
+          change.After = encodeTree(withoutViewOnly(change.Path, newValue))
+        }
+        *changes = append(*changes, change)
+      }
+      return
+    }
+  case []interface{}:
+    if new, ok := after.([]interface{}); ok {
+      if len(old) == len(new) {
+        for index := range old {
+          diffTree(subPath(path, strconv.Itoa(index)), old[index], new[index], changes)
+        }
+        return
+      }
+      // Only the items between the common start and end are replaced
+      same := func(oldIndex, newIndex int) bool {
+        return reflect.DeepEqual(withoutViewOnly(subPath(path, strconv.Itoa(oldIndex)), old[oldIndex]),
+          withoutViewOnly(subPath(path, strconv.Itoa(newIndex)), new[newIndex]))
+      }
+      start := 0
+      for start < len(old) && start < len(new) && same(start, start) {
+        start++
+      }
+      end := 0
+      for end < len(old) - start && end < len(new) - start && same(len(old) - 1 - end, len(new) - 1 - end) {
+        end++
+      }
+      splicePath := subPath(path, strconv.Itoa(start))
+      var removed, added []interface{}
+      for _, item := range old[start:len(old) - end] {
+        removed = append(removed, withoutViewOnly(splicePath, item))
+      }
+      for _, item := range new[start:len(new) - end] {
+        added = append(added, withoutViewOnly(splicePath, item))
+      }
+      *changes = append(*changes, Change{
+        Path: splicePath,
+        Splice: true,
+        Removed: encodeTrees(removed),
+        Added: encodeTrees(added),
+      })
+      return
+    }
+  }
+  *changes = append(*changes, Change{Path: path, Before: encodeTree(withoutViewOnly(path, before)),
+    After: encodeTree(withoutViewOnly(path, after))})
+}
+
+
+// *******************************
+// Changes between two snapshots of the document
+// *******************************
+func diffSnapshots(before, after []byte) ([]Change, error) {
+  oldTree, err := decodeTree(before)
+  if err != nil {
+    return nil, err
+  }
+  newTree, err := decodeTree(after)
+  if err != nil {
+    return nil, err
+  }
+  var changes []Change
+  diffTree(nil, oldTree, newTree, &changes)
+  return changes, nil
+}
+
+
+// *******************************
+// Change that reverts this one
+// *******************************
+func (change Change) inverse() Change {
+  change.Before, change.After = change.After, change.Before
+  change.Removed, change.Added = change.Added, change.Removed
+  return change
+}
+
+
+// *******************************
+// Apply a change to the value at the path, returning the new value
+// Values are only changed if they are still the ones before the
+// change, and splices if the removed items are still there
+// *******************************
+func applyChange(node interface{}, path []string, change Change) (interface{}, error) {
+  if len(path) == 0 {
+    return nil, fmt.Errorf("Empty change path")
+  }
+  key, last := path[0], len(path) == 1
+
+  switch container := node.(type) {
+  case map[string]interface{}:
+    if last {
+      current, present := container[key]
+      if same, err := sameValue(change.Path, change.Before, current, present); err != nil || !same {
+        return nil, changedError(change.Path, err)
+      }
+      if change.After == nil {
+        delete(container, key)
+        return container, nil
+      }
+      value, err := decodeTree(change.After)
+      container[key] = value
+      return container, err
+    }
+    child, ok := container[key]
+    if !ok {
+      return nil, fmt.Errorf("Missing %s", strings.Join(change.Path, "."))
+    }
+    child, err := applyChange(child, path[1:], change)
+    container[key] = child
+    return container, err
+
+  case []interface{}:
+    index, err := strconv.Atoi(key)
+    if err != nil || index < 0 || index > len(container) || (index == len(container) && !(last && change.Splice)) {
+      return nil, fmt.Errorf("Missing %s", strings.Join(change.Path, "."))
+    }
+    if last && change.Splice {
+      if index + len(change.Removed) > len(container) {
+        return nil, fmt.Errorf("Missing items of %s", strings.Join(change.Path, "."))
+      }
+      for offset, raw := range change.Removed {
+        value, err := decodeTree(raw)
+        if err != nil {
+          return nil, err
+        }
+        if !reflect.DeepEqual(withoutViewOnly(change.Path, container[index + offset]), withoutViewOnly(change.Path, value)) {
+          return nil, fmt.Errorf("Items of %s changed", strings.Join(change.Path, "."))
+        }
+      }
+      result := append([]interface{}{}, container[:index]...)
+      for _, raw := range change.Added {
+        value, err := decodeTree(raw)
+        if err != nil {
+          return nil, err
+        }
+        result = append(result, withoutViewOnly(change.Path, value))
+      }
+      return append(result, container[index + len(change.Removed):]...), nil
+    }
+    if last {
+      if same, err := sameValue(change.Path, change.Before, container[index], true); err != nil || !same {
+        return nil, changedError(change.Path, err)
+      }
+      value, err := decodeTree(change.After)
+      container[index] = value
+      return container, err
+    }
+    child, err := applyChange(container[index], path[1:], change)
+    container[index] = child
+    return container, err
+  }
+  return nil, fmt.Errorf("Missing %s", strings.Join(change.Path, "."))
+}
+
+
+// *******************************
+// Error of a value that is not the one before the change
+// *******************************
+func changedError(path []string, err error) error {
+  if err != nil {
+    return err
+  }
+  return fmt.Errorf("Value of %s changed", strings.Join(path, "."))
+}
+
+
+// *******************************
+// Apply the changes of an operation to a snapshot, or revert them
+// Changes of view-only fields, logged by older versions, are skipped
+// *******************************
+func applyChanges(snapshot []byte, changes []Change, revert bool) ([]byte, error) {
+  tree, err := decodeTree(snapshot)
+  if err != nil {
+    return nil, err
+  }
+  for index := range changes {
+    change := changes[index]
+    if revert {
+      change = changes[len(changes) - 1 - index].inverse()
+    }
+    if isViewOnly(change.Path) {
+      continue
+    }
+    if tree, err = applyChange(tree, change.Path, change); err != nil {
+      return nil, err
+    }
+  }
+  return json.Marshal(tree)
+}
+
+
+// *******************************
+// Append an operation to the log, returns its sequence number
+// *******************************
+func (doc *Document) pushOp(op Operation) int {
+  op.Seq = len(doc.Operations) + 1
+  doc.Operations = append(doc.Operations, op)
+  return op.Seq
+}
+
+
+// *******************************
+// Last operation that can be undone or redone, 0 if none
+// *******************************
+func (history *History) lastOf(stack []int) int {
+  if len(stack) == 0 {
+    return 0
+  }
+  return stack[len(stack) - 1]
+}
+
+func (history *History) CanUndo() bool {
+  return history.lastOf(history.undo) != 0
+}
+
+func (history *History) CanRedo() bool {
+  return history.lastOf(history.redo) != 0
+}
+
+
+// *******************************
+// Form values of the request, without passwords
+// *******************************
+func opParams(r *http.Request) string {
+  var params []string
+  for key, values := range r.Form {
+    if strings.Contains(strings.ToLower(key), "password") {
+      continue
+    }
+    params = append(params, key + "=" + strings.Join(values, ","))
+  }
+  sort.Strings(params)
+  return strings.Join(params, " ")
+}
+
+
+// *******************************
+// Buffer the response, so it can be sent after recording the operation
+// *******************************
+type bufferedResponse struct {
+  http.ResponseWriter
+  code  int
+  body  bytes.Buffer
+}
+
+func (buffer *bufferedResponse) WriteHeader(code int) {
+  buffer.code = code
+}
+
+func (buffer *bufferedResponse) Write(b []byte) (int, error) {
+  return buffer.body.Write(b)
+}
+
+
+// *******************************
+// Record the changes made by a handler as an operation
+// Requests that don't change the document are not recorded
+// *******************************
+func (doc *Document) record(name string, next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    before, err := doc.snapshot()
+    if err != nil {
+      fmt.Println(err)
+    }
+
+    buffer := &bufferedResponse{ResponseWriter: w, code: http.StatusOK}
+    next(buffer, r)
+
+    after, err := doc.snapshot()
+    var changes []Change
+    if err == nil && before != nil && !bytes.Equal(before, after) {
+      if changes, err = diffSnapshots(before, after); err != nil {
+        fmt.Println(err)
+      }
+    }
+    if len(changes) > 0 {
+      op := Operation{Name: name, Params: opParams(r), Time: time.Now(), Changes: changes}
+      if user := currentUser(r); user != nil {
+        op.User = user.Name
+      }
+      history := doc.opHistory()
+      history.undo = append(history.undo, doc.pushOp(op))
+      history.redo = nil
+
+      if previous, err := fromSnapshot(before); err == nil {
+        doc.audit(previous, op)
+      }
+    }
+
+    w.WriteHeader(buffer.code)
+    w.Write(buffer.body.Bytes())
+  }
+}
+
+
+// *******************************
+// Replace the document content with a snapshot, keeping
+// the state that is not stored
+// *******************************
+func (doc *Document) restore(snapshot []byte) error {
+  restored := Document{}
+  if err := json.Unmarshal(snapshot, &restored); err != nil {
+    return err
+  }
+  restored.passphrase = doc.passphrase
+  restored.basePath = doc.basePath
+  restored.history = doc.history
+  restored.mutex = doc.mutex
+  restored.pendingMerge = doc.pendingMerge
+  restored.Notices = doc.Notices
+  restored.Audit = doc.Audit
+  restored.Operations = doc.Operations
+  restored.savedAudit = doc.savedAudit
+  restored.versioned = doc.versioned
+  restored.attachments = doc.attachments
+  *doc = restored
+  doc.invalidateAllStats()
+  doc.calcAllStats()
+  return nil
+}
+
+
+// *******************************
+// Undo the last operation, or redo the last undone one
+// *******************************
+func (doc *Document) undoRedo(undo bool, user *UserAccount) error {
+  history := doc.opHistory()
+  from, to, name := &history.undo, &history.redo, opUndo
+  if !undo {
+    from, to, name = &history.redo, &history.undo, opRedo
+  }
+
+  // The merge under review was computed from the current content
+  if doc.pendingMerge != nil {
+    return fmt.Errorf("Apply or cancel the pending merge before you %s", name)
+  }
+  seq := history.lastOf(*from)
+  if seq == 0 {
+    return fmt.Errorf("Nothing to %s", name)
+  }
+  target := &doc.Operations[seq - 1]
+  if target.Changes == nil {
+    return fmt.Errorf("Operation %d has no changes to %s", seq, name)
+  }
+  current, err := doc.snapshot()
+  if err != nil {
+    return err
+  }
+  snapshot, err := applyChanges(current, target.Changes, undo)
+  if err != nil {
+    return fmt.Errorf("Operation %d can not %s, the document changed: %v", seq, name, err)
+  }
+  previous, err := fromSnapshot(current)
+  if err != nil {
+    return err
+  }
+  if err := doc.restore(snapshot); err != nil {
+    return err
+  }
+  // The shown sheet is not undone, unless it was removed
+  shown := false
+  for _, month := range doc.MonthRecs {
+    shown = shown || month.ActiveGroup
+  }
+  if !shown && len(doc.MonthRecs) > 0 {
+    doc.MonthRecs[len(doc.MonthRecs) - 1].ActiveGroup = true
+  }
+
+  target.Undone = undo
+  *from = (*from)[:len(*from) - 1]
+  *to = append(*to, seq)
+
+  op := Operation{Name: name, Params: target.Name, Time: time.Now(), Target: seq}
+  if user != nil {
+    op.User = user.Name
+  }
+  doc.pushOp(op)
+  doc.audit(previous, op)
+  return nil
+}
+
+
+// *******************************
+// Undo or redo from the buttons
+// *******************************
+func (doc *Document) undoRedoHandler(undo bool) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if err := doc.undoRedo(undo, currentUser(r)); err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Page with the operations of the document, newest first
+// *******************************
+func (doc *Document) historyHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    history := doc.opHistory()
+    ops := make([]Operation, len(doc.Operations))
+    for index, op := range doc.Operations {
+      ops[len(ops) - 1 - index] = op
+    }
+
+    data := struct {
+      Doc      *Document
+      History  *History
+      Ops      []Operation
+    }{doc, history, ops}
+    if err := historyTpl.Execute(w, data); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
+
+
+// *******************************
+// Undo state used by the main template
+// *******************************
+func (doc *Document) History() *History {
+  return doc.opHistory()
+}
+
+
+// *******************************
+// Serve the requests of the document one at a time, so
+// concurrent users don't change it at once
+// *******************************
+func (doc *Document) locked(next http.Handler) http.HandlerFunc {
+  if doc.mutex == nil {
+    doc.mutex = &sync.Mutex{}
+  }
+  return func(w http.ResponseWriter, r *http.Request) {
+    doc.mutex.Lock()
+    defer doc.mutex.Unlock()
+    next.ServeHTTP(w, r)
+  }
+}
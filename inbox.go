@@ -0,0 +1,148 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+
+// *******************************
+// Create an empty sheet for the calendar month of a date
+// *******************************
+func newCalendarMonthRec(date time.Time) *MonthRec {
+  monthRec := newMonthRec()
+  monthRec.StartDate = time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.Now().Location())
+  monthRec.GroupName = monthRec.StartDate.Format("2006-01")
+  return monthRec
+}
+
+
+// *******************************
+// Check if a sheet name is already used
+// *******************************
+func (doc *Document) hasSheet(name string) bool {
+  for _, month := range doc.MonthRecs {
+    if month.GroupName == name {
+      return true
+    }
+  }
+  return false
+}
+
+
+// *******************************
+// Add a new sheet with its recurring entries and keep months sorted
+// *******************************
+func (doc *Document) insertSheet(monthRec *MonthRec) error {
+  if err := doc.checkOpenPeriod(monthRec.StartDate); err != nil {
+    return err
+  }
+
+  doc.materializeRecurring(monthRec)
+  doc.MonthRecs = append(doc.MonthRecs, *monthRec)
+  doc.sortMonthsByDate()
+  return nil
+}
+
+
+// *******************************
+// Place an entry in the sheet containing its date
+// Entries that fit nowhere go to the inbox, unless autoCreate
+// is set and a sheet for the calendar month can be created
+// *******************************
+func (doc *Document) placeEntry(entry EntryRec, autoCreate bool) bool {
+  if index, ok := doc.findPeriodFor(entry.Date); ok {
+    doc.MonthRecs[index].EntryRecords = append(doc.MonthRecs[index].EntryRecords, entry)
+    doc.MonthRecs[index].sortRecordsByDate()
+    doc.invalidateStats(index)
+    return true
+  }
+
+  if autoCreate && !entry.Date.IsZero() {
+    monthRec := newCalendarMonthRec(entry.Date)
+    if !doc.hasSheet(monthRec.GroupName) && doc.insertSheet(monthRec) == nil {
+      index, _ := doc.findPeriodFor(entry.Date)
+      doc.MonthRecs[index].EntryRecords = append(doc.MonthRecs[index].EntryRecords, entry)
+      doc.MonthRecs[index].sortRecordsByDate()
+      doc.addNotice(fmt.Sprintf("Created sheet %s for entry on %s", monthRec.GroupName, entry.Date.Format("2006-01-02")))
+      return true
+    }
+  }
+
+  doc.Inbox = append(doc.Inbox, entry)
+  if err := doc.checkOpenPeriod(entry.Date); err != nil {
+    doc.addNotice(err.Error() + ", entry moved to the inbox")
+  } else {
+    doc.addNotice(fmt.Sprintf("Date %s did not fit in any sheet, entry moved to the inbox", entry.Date.Format("2006-01-02")))
+  }
+  return false
+}
+
+
+// *******************************
+// Move an inbox entry to a sheet, or to the sheet containing
+// its date when no sheet name is given
+// *******************************
+func (doc *Document) assignInboxEntry(inboxIdx int, sheetName string) error {
+  if inboxIdx < 0 || inboxIdx >= len(doc.Inbox) {
+    return fmt.Errorf("Inbox entry %d does not exist", inboxIdx)
+  }
+  entry := doc.Inbox[inboxIdx]
+
+  monthIdx := -1
+  if sheetName == "" {
+    if index, ok := doc.findPeriodFor(entry.Date); ok {
+      monthIdx = index
+    }
+  } else {
+    for index, month := range doc.MonthRecs {
+      if month.GroupName == sheetName {
+        monthIdx = index
+      }
+    }
+  }
+  if monthIdx < 0 {
+    return fmt.Errorf("No sheet found for inbox entry on %s", entry.Date.Format("2006-01-02"))
+  }
+  if doc.MonthRecs[monthIdx].Closed {
+    return fmt.Errorf("Month %s is closed", doc.MonthRecs[monthIdx].GroupName)
+  }
+
+  doc.MonthRecs[monthIdx].EntryRecords = append(doc.MonthRecs[monthIdx].EntryRecords, entry)
+  doc.MonthRecs[monthIdx].sortRecordsByDate()
+  doc.invalidateStats(monthIdx)
+  doc.Inbox = append(doc.Inbox[:inboxIdx], doc.Inbox[inboxIdx + 1:]...)
+  return nil
+}
+
+
+// *******************************
+// Assign or discard an inbox entry from form
+// *******************************
+func (doc *Document) assignInbox() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    defer doc.render(w, r)
+
+    inboxIdx, err := strconv.Atoi(r.FormValue("inboxIndex"))
+    if err != nil {
+      doc.addNotice(err.Error())
+      return
+    }
+
+    if r.FormValue("discard") != "" {
+      if inboxIdx >= 0 && inboxIdx < len(doc.Inbox) {
+        doc.Inbox = append(doc.Inbox[:inboxIdx], doc.Inbox[inboxIdx + 1:]...)
+      }
+      return
+    }
+
+    if err := doc.assignInboxEntry(inboxIdx, r.FormValue("inboxSheet")); err != nil {
+      doc.addNotice(err.Error())
+      return
+    }
+
+    doc.calcAllStats()
+  }
+}
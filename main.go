@@ -1,6 +1,8 @@
 package main
 
 import (
+  "errors"
+  "flag"
   "fmt"
   "net/http"
   "html/template"
@@ -10,21 +12,48 @@ import (
   "sort"
   "path/filepath"
   "os"
-  "encoding/json"
-  "io/ioutil"
+  "sync"
 )
 
 
 type Document struct {
+  Version       int
   PrevDebt      map[string]float64
   Categories    []string
   Payers        []string
+  InactivePayers []string
+  Roles         map[string]string
+  Groups        []PayerGroup
   Currencies    []string
   LastUsedCat   string
   LastUsedPayer string
+  LastUsedGroup string
   LastUsedCurr  string
   LastUsedDate  time.Time
+  RateMode      string
+  Recurring     []RecurringEntry
   MonthRecs     []MonthRec
+  Inbox         []EntryRec
+  Audit         []AuditEvent
+  Operations    []Operation
+  Notices       []string `json:"-"`
+
+  // Passphrase of the encrypted file, empty when stored in plain text
+  passphrase    string
+  // Path the document routes are served under, empty for a single document
+  basePath      string
+  // Operations that can be undone and redone, rebuilt from Operations
+  history       *History
+  // Held while serving a request, several users share the document
+  mutex         *sync.Mutex
+  // Merge with another copy waiting for its conflicts to be solved
+  pendingMerge  *MergeResult
+  // Audit events already saved, the newer ones describe the next save
+  savedAudit    int
+  // Saves are kept as revisions by the storage
+  versioned     bool
+  // Directory with the receipts of the entries
+  attachments   string
 }
 
 var (
@@ -33,19 +62,52 @@ var (
 )
 
 
+// *******************************
+// Prefix of the document links in the templates
+// *******************************
+func (doc *Document) Base() string {
+  return doc.basePath
+}
+
+
+// *******************************
+// Check if the saved revisions can be shown
+// *******************************
+func (doc *Document) HasRevisions() bool {
+  return doc.versioned
+}
+
+
+// *******************************
+// Show a message to the user in the next rendered page
+// *******************************
+func (doc *Document) addNotice(notice string) {
+  fmt.Println(notice)
+  doc.Notices = append(doc.Notices, notice)
+}
+
+
+// *******************************
+// Render the main page, shown notices are cleared
+// *******************************
+func (doc *Document) render(w http.ResponseWriter, r *http.Request) {
+  if err := tpl.Execute(w, pageData{doc, currentUser(r)}); err != nil {
+    fmt.Println(err)
+  }
+  doc.Notices = nil
+}
+
+
 // *******************************
 // Entry point from loaded or empty entries
 // *******************************
 func (doc *Document) indexHandler() http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
 
-    // TODO this should't be called every time, they should always be sorted
-    doc.sortMonthsByDate()
-
-    // TODO don't recalculate stats on just opening a file
+    // Only months changed since the last view are recalculated
     doc.calcAllStats()
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -58,14 +120,36 @@ func (doc *Document) calcExchRate() http.HandlerFunc {
 
     for index, month := range doc.MonthRecs {
       if month.ActiveGroup {
+        if month.Closed {
+          doc.addNotice(fmt.Sprintf("Month %s is closed", month.GroupName))
+          break
+        }
         doc.MonthRecs[index].AvgExchRates = month.ExchRatesCalcs()
+        doc.invalidateStats(index)
+
+        failed := 0
+        var errs []string
+        for _, entry := range doc.MonthRecs[index].EntryRecords {
+          if entry.RateError != "" {
+            failed++
+            if !containsStr(errs, entry.RateError) {
+              errs = append(errs, entry.RateError)
+            }
+          }
+        }
+        if failed > 0 {
+          doc.addNotice(fmt.Sprintf("%d entries of %s failed to convert, marked in the entries table", failed, month.GroupName))
+        }
+        for _, err := range errs {
+          doc.addNotice("Exchange rate error: " + err)
+        }
         break
       }
     }
 
     doc.calcAllStats()
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -76,7 +160,8 @@ func (doc *Document) calcExchRate() http.HandlerFunc {
 func newDocument() *Document {
   doc := &Document{}
   // Default values for Document
-  doc.Payers = append(doc.Payers, "All")
+  doc.Version = documentVersion
+  doc.Groups = append(doc.Groups, PayerGroup{Name: defaultGroupName})
   doc.Currencies = append(doc.Currencies, "EUR")
   doc.LastUsedDate = time.Now()
   return doc
@@ -91,7 +176,7 @@ func (doc *Document) addCategory() http.HandlerFunc {
     newCategory := strings.TrimSpace(r.FormValue("newCategory"))
     doc.Categories = append(doc.Categories, newCategory)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -117,7 +202,7 @@ func (doc *Document) addPayer() http.HandlerFunc {
     // Put new payer on top
     doc.Payers = prependStr(doc.Payers, newPayer)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -131,26 +216,54 @@ func (doc *Document) addCurrency() http.HandlerFunc {
     // TODO check that length is 3 and capital letters
     doc.Currencies = append(doc.Currencies, newCurrency)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
 
+// *******************************
+// Mark the statistics of a month, and so of all the following
+// ones, to be recalculated
+// *******************************
+func (doc *Document) invalidateStats(index int) {
+  if index >= 0 && index < len(doc.MonthRecs) {
+    doc.MonthRecs[index].statsValid = false
+  }
+}
+
+
+// *******************************
+// Mark the statistics of all months to be recalculated
+// *******************************
+func (doc *Document) invalidateAllStats() {
+  doc.invalidateStats(0)
+}
+
+
 // *******************************
 // Calculate all months statistics
+// Only the first month with changes and the ones after it are
+// recalculated, closed months keep their statistics
 // *******************************
 func (doc *Document) calcAllStats() {
-  // Recalculate month statistics
   // Months sorted by date is assumed
-  for index, month := range doc.MonthRecs {
-    // TODO Introduce checks to not calculate this every time
-    // TODO calculate only from current month, without the previous ones
+  start := len(doc.MonthRecs)
+  for index := doc.lastClosedIndex() + 1; index < len(doc.MonthRecs); index++ {
+    if !doc.MonthRecs[index].statsValid {
+      start = index
+      break
+    }
+  }
+
+  for index := start; index < len(doc.MonthRecs); index++ {
+    month := doc.MonthRecs[index]
     if index == 0 {
-      doc.MonthRecs[index].Stats = month.calcStats(nil, doc.PrevDebt)
+      doc.MonthRecs[index].Stats = month.calcStats(nil, doc.PrevDebt, doc.Groups, doc.RateMode)
     } else {
       // TODO probably doesn't need a pointer to all the data
-      doc.MonthRecs[index].Stats = month.calcStats(&(doc.MonthRecs[index - 1]), doc.PrevDebt)
+      doc.MonthRecs[index].Stats = month.calcStats(&(doc.MonthRecs[index - 1]), doc.PrevDebt, doc.Groups, doc.RateMode)
     }
+    doc.MonthRecs[index].statsValid = true
   }
 }
 
@@ -171,11 +284,12 @@ func (doc *Document) addPreviousDebts() http.HandlerFunc {
 
     if convQuantity, err := strconv.ParseFloat(prevAmount, 64); err == nil {
       doc.PrevDebt[prevName] = convQuantity
+      doc.invalidateAllStats()
     }
 
     doc.calcAllStats()
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -210,48 +324,79 @@ func (doc *Document) addEntry() http.HandlerFunc {
     r.ParseForm()
 
     entry := EntryRec{
+      ID: newEntryID(),
+      Kind: r.FormValue("kind"),
+      RefundOf: r.FormValue("refundOf"),
       Date: recDate,
       Category: r.FormValue("category"),
       PersonName: r.FormValue("who"),
+      SharedGroup: r.FormValue("shared"),
       Currency: r.FormValue("currency"),
       Amount: 0.0,
       Comment: r.FormValue("comment"),
     }
 
+    // Shared expenses are not paid by a single person
+    if entry.SharedGroup != "" {
+      entry.PersonName = ""
+    }
+
+    // Members only add their own or shared entries
+    user := currentUser(r)
+    if user != nil {
+      entry.CreatedBy = user.Name
+    }
+    if !doc.hasRole(user, roleOwner) && entry.SharedGroup == "" && entry.PersonName != user.Payer {
+      doc.addNotice("Members can only add entries paid by themselves or shared")
+      doc.render(w, r)
+      return
+    }
+
+    // Refunds take the category of the refunded expense
+    if entry.Kind != kindRefund {
+      entry.RefundOf = ""
+    } else if refunded, ok := doc.findEntry(entry.RefundOf); ok {
+      entry.Category = refunded.Category
+    }
+
     if convAmount, err := strconv.ParseFloat(r.FormValue("quantity"), 64); err == nil {
       entry.Amount = convAmount
     } else {
       fmt.Println("There was an error processing the quantity input: not a float64")
     }
 
-    // Find correct month to insert to
-    for index, month := range doc.MonthRecs {
-      if isSameMonthYear(recDate, month.StartDate) {
-
-        if entry.Currency == "EUR" {
-          entry.ExchRate = 1.0
-        } else {
-          entry.ExchRate = 0.0
-        }
-
-        // Add entry to the list and sort
-        doc.MonthRecs[index].EntryRecords = append(doc.MonthRecs[index].EntryRecords, entry)
-        doc.MonthRecs[index].sortRecordsByDate()
+    if entry.Currency == "EUR" {
+      entry.ExchRate = 1.0
+    } else {
+      entry.ExchRate = 0.0
+    }
 
-        break
-      }
+    // Rate charged, as shown in the card statement
+    if manualRate, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("rate")), 64); err == nil && manualRate > 0.0 {
+      entry.ExchRate = manualRate
+      entry.ManualRate = true
+    }
 
-      // Check for last item
-      if index + 1 == len(doc.MonthRecs) {
-        fmt.Printf("Date %s did not fit in any current month", recDate)
+    // Receipt photo or PDF, stored by its content
+    if file, _, err := r.FormFile("receipt"); err == nil {
+      defer file.Close()
+      if entry.Attachment, err = doc.storeAttachment(file); err != nil {
+        doc.addNotice(err.Error())
+        doc.render(w, r)
+        return
       }
     }
 
+    // Find correct period to insert to, only owners create sheets
+    // and entries of members without sheet wait in the inbox
+    autoCreate := r.FormValue("autoCreate") != "" && doc.hasRole(user, roleOwner)
+    doc.placeEntry(entry, autoCreate)
+
     doc.calcAllStats()
 
-    doc.updateLastUsed(entry.Category, entry.PersonName, entry.Currency, entry.Date)
+    doc.updateLastUsed(entry.Category, entry.PersonName, entry.SharedGroup, entry.Currency, entry.Date)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -259,9 +404,12 @@ func (doc *Document) addEntry() http.HandlerFunc {
 // *******************************
 // Change active month to selected month
 // *******************************
-func (doc *Document) updateLastUsed(lastCat, lastPayer, lastCurr string, lastDate time.Time) {
+func (doc *Document) updateLastUsed(lastCat, lastPayer, lastGroup, lastCurr string, lastDate time.Time) {
   doc.LastUsedCat = lastCat
-  doc.LastUsedPayer = lastPayer
+  if lastPayer != "" {
+    doc.LastUsedPayer = lastPayer
+  }
+  doc.LastUsedGroup = lastGroup
   doc.LastUsedCurr = lastCurr
   doc.LastUsedDate = lastDate
 }
@@ -278,7 +426,7 @@ func (doc *Document) changeToSheet() http.HandlerFunc {
 
     doc.markMonthAsActive(selectedSheet)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -294,20 +442,24 @@ func (doc *Document) sortMonthsByDate() {
 
 
 // *******************************
-// Write changes into a JSON file
+// Write changes into the storage of the document
 // *******************************
-func (doc *Document) writeJson(fileName string) http.HandlerFunc {
+func (doc *Document) writeJson(store Storage) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
-    b, err := json.MarshalIndent(doc, "", " ")
-    if err != nil {
+    t := time.Now()
+    fmt.Printf("Saving current data at %s in %s\n", t.Format("15:04:05"), store)
+    userName := ""
+    if user := currentUser(r); user != nil {
+      userName = user.Name
+    }
+    if err := store.Save(doc, userName); err != nil {
         fmt.Println(err)
-        return
+        doc.addNotice("Could not save the document: " + err.Error())
+    } else {
+        doc.savedAudit = len(doc.Audit)
     }
-    t := time.Now()
-    fmt.Printf("Saving current data at %s in file named %s\n", t.Format("15:04:05"), fileName)
-    _ = ioutil.WriteFile(fileName, b, 0644)
 
-    tpl.Execute(w, doc)
+    doc.render(w, r)
   }
 }
 
@@ -334,89 +486,189 @@ func (doc *Document) markMonthAsActive(name string) {
 func (doc *Document) addSheet() http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
 
-    defer tpl.Execute(w, doc)
+    defer doc.render(w, r)
 
     monthRec := newMonthRec()
 
     inputName := strings.TrimSpace(r.FormValue("sheetName"))
 
     // Check if name was already used
-    for _, month := range doc.MonthRecs {
-      if inputName == month.GroupName {
-        fmt.Printf("Name %s was already used.", inputName)
-        return
-      }
+    if doc.hasSheet(inputName) {
+      doc.addNotice(fmt.Sprintf("Name %s was already used.", inputName))
+      return
     }
     monthRec.GroupName = inputName
 
     // If no input is provided, use date
-    if monthRec.GroupName == "" {
+    if monthRec.GroupName == "" && r.FormValue("periodStart") == "" {
       selectedMonthYear := r.FormValue("monthYearSheet")
       // Check if name was already used
-      for _, month := range doc.MonthRecs {
-        if selectedMonthYear == month.GroupName {
-          fmt.Sprintf("Name %s was already used.", inputName)
-          return
-        }
+      if doc.hasSheet(selectedMonthYear) {
+        doc.addNotice(fmt.Sprintf("Name %s was already used.", selectedMonthYear))
+        return
       }
       monthRec.GroupName = selectedMonthYear
     }
 
-    // Create starting date for new month
-    monthYearSlice := strings.Split(r.FormValue("monthYearSheet"), "-")
+    // Sheets for arbitrary periods, like trips, give start and end days
+    if r.FormValue("periodStart") != "" {
+      startDate, err := time.ParseInLocation("2006-01-02", r.FormValue("periodStart"), time.Now().Location())
+      if err != nil {
+        fmt.Println(err)
+        return
+      }
+      endDate, err := time.ParseInLocation("2006-01-02", r.FormValue("periodEnd"), time.Now().Location())
+      if err != nil {
+        fmt.Println(err)
+        return
+      }
+      if endDate.Before(startDate) {
+        fmt.Printf("Period end %s is before its start %s", endDate, startDate)
+        return
+      }
+      if inputName == "" {
+        monthRec.GroupName = startDate.Format("2006-01-02") + "/" + endDate.Format("2006-01-02")
+      }
+      monthRec.StartDate = startDate
+      monthRec.EndDate = endDate
+    } else {
+      // Create starting date for new month
+      monthYearSlice := strings.Split(r.FormValue("monthYearSheet"), "-")
+      if len(monthYearSlice) != 2 {
+        fmt.Printf("Month %s not in YYYY-MM format", r.FormValue("monthYearSheet"))
+        return
+      }
 
-    sheetYear, err := strconv.Atoi(monthYearSlice[0])
-    if err != nil {
-      fmt.Println(err)
-      return
+      sheetYear, err := strconv.Atoi(monthYearSlice[0])
+      if err != nil {
+        fmt.Println(err)
+        return
+      }
+
+      monthNum, err := strconv.Atoi(monthYearSlice[1])
+      if err != nil {
+        fmt.Println(err)
+        return
+      }
+
+      firstDayMonth := time.Date(sheetYear, time.Month(monthNum), 1, 0, 0, 0, 0, time.Now().Location())
+      monthRec.StartDate = firstDayMonth
     }
 
-    monthNum, err := strconv.Atoi(monthYearSlice[1])
-    if err != nil {
-      fmt.Println(err)
+    if doc.hasSheet(monthRec.GroupName) {
+      doc.addNotice(fmt.Sprintf("Name %s was already used.", monthRec.GroupName))
       return
     }
 
-    firstDayMonth := time.Date(sheetYear, time.Month(monthNum), 1, 0, 0, 0, 0, time.Now().Location())
-    monthRec.StartDate = firstDayMonth
+    // Add it do the document with the entries repeated every month
+    if err := doc.insertSheet(monthRec); err != nil {
+      doc.addNotice(err.Error())
+      return
+    }
 
     // Mark new month as active
     doc.markMonthAsActive(monthRec.GroupName)
 
-    // Add it do the document and sort months
-    doc.MonthRecs = append(doc.MonthRecs, *monthRec)
-    doc.sortMonthsByDate()
+    // Entries waiting in the inbox may fit in the new sheet
+    for inboxIdx := len(doc.Inbox) - 1; inboxIdx >= 0; inboxIdx-- {
+      if monthRec.contains(doc.Inbox[inboxIdx].Date) {
+        doc.assignInboxEntry(inboxIdx, "")
+      }
+    }
+
+    doc.calcAllStats()
   }
 }
 
 
-func main() {
-  port := "3000"
+// *******************************
+// Routes of a document, relative to its base path
+// *******************************
+func (doc *Document) routes(users *UserStore, store Storage) http.Handler {
+  mux := http.NewServeMux()
+  doc.attachments = attachmentsDirOf(store.String())
+
+  mux.HandleFunc("/addUser", users.addUserHandler(doc))
+  mux.HandleFunc("/setRole", doc.allow(roleOwner, doc.record("setRole", doc.setRoleHandler())))
+
+  mux.HandleFunc("/writeJSON", doc.allow(roleMember, doc.writeJson(store)))
+
+  mux.HandleFunc("/addCategory", doc.allow(roleOwner, doc.record("addCategory", doc.addCategory())))
+  mux.HandleFunc("/addWho", doc.allow(roleOwner, doc.record("addWho", doc.addPayer())))
+  mux.HandleFunc("/renamePayer", doc.allow(roleOwner, doc.record("renamePayer", doc.renamePayerHandler(users))))
+  mux.HandleFunc("/mergePayers", doc.allow(roleOwner, doc.record("mergePayers", doc.mergePayersHandler(users))))
+  mux.HandleFunc("/togglePayer", doc.allow(roleOwner, doc.record("togglePayer", doc.togglePayerHandler())))
+  mux.HandleFunc("/addGroup", doc.allow(roleOwner, doc.record("addGroup", doc.addGroup())))
+  mux.HandleFunc("/renameGroup", doc.allow(roleOwner, doc.record("renameGroup", doc.renameGroupHandler())))
+  mux.HandleFunc("/addCurrency", doc.allow(roleOwner, doc.record("addCurrency", doc.addCurrency())))
+  mux.HandleFunc("/inputPreviousDebts", doc.allow(roleOwner, doc.record("inputPreviousDebts", doc.addPreviousDebts())))
+
+  mux.HandleFunc("/changeSheet", doc.allow(roleViewer, doc.changeToSheet()))
+  mux.HandleFunc("/closeSheet", doc.allow(roleOwner, doc.record("closeSheet", doc.closeMonthHandler())))
+  mux.HandleFunc("/editSheet", doc.allow(roleOwner, doc.record("editSheet", doc.editSheet())))
+
+  mux.HandleFunc("/addSheet", doc.allow(roleOwner, doc.record("addSheet", doc.addSheet())))
+  mux.HandleFunc("/addRecurring", doc.allow(roleOwner, doc.record("addRecurring", doc.addRecurring())))
+  mux.HandleFunc("/removeRecurring", doc.allow(roleOwner, doc.record("removeRecurring", doc.removeRecurring())))
+  mux.HandleFunc("/calcExchRateMonth", doc.allow(roleOwner, doc.record("calcExchRateMonth", doc.calcExchRate())))
+  mux.HandleFunc("/setEntryRate", doc.allow(roleMember, doc.record("setEntryRate", doc.setEntryRateHandler())))
+  mux.HandleFunc("/setRateMode", doc.allow(roleOwner, doc.record("setRateMode", doc.setRateMode())))
+
+  mux.HandleFunc("/addEntry", doc.allow(roleMember, doc.record("addEntry", doc.addEntry())))
+  mux.HandleFunc("/assignInbox", doc.allow(roleOwner, doc.record("assignInbox", doc.assignInbox())))
+  mux.HandleFunc("/undo", doc.allow(roleOwner, doc.undoRedoHandler(true)))
+  mux.HandleFunc("/redo", doc.allow(roleOwner, doc.undoRedoHandler(false)))
+  mux.HandleFunc("/history", doc.allow(roleViewer, doc.historyHandler()))
+  mux.HandleFunc("/audit", doc.allow(roleViewer, doc.auditHandler()))
+  mux.HandleFunc("/merge", doc.allow(roleOwner, doc.mergeHandler()))
+  mux.HandleFunc("/applyMerge", doc.allow(roleOwner, doc.record("merge", doc.applyMergeHandler())))
+  if git, ok := store.(*gitStorage); ok {
+    doc.versioned = true
+    mux.HandleFunc("/revisions", doc.allow(roleViewer, git.revisionsHandler(doc)))
+  }
+  mux.HandleFunc("/backup", doc.allow(roleOwner, doc.backupHandler()))
+  mux.HandleFunc("/search", doc.allow(roleViewer, doc.searchHandler()))
+  mux.HandleFunc("/api/search", doc.allow(roleViewer, doc.searchApiHandler()))
+  mux.HandleFunc("/report", doc.allow(roleViewer, doc.reportHandler()))
+  mux.HandleFunc("/chart.svg", doc.allow(roleViewer, doc.chartHandler()))
+  mux.HandleFunc("/", doc.allow(roleViewer, doc.indexHandler()))
+
+  // Receipts are decrypted outside the lock, as each one derives its key
+  unlocked := http.NewServeMux()
+  unlocked.Handle("/", doc.locked(mux))
+  unlocked.HandleFunc("/attachment", doc.attachmentHandler())
+  return unlocked
+}
 
-  document := newDocument()
 
-  // Check input file type
-  if inputFileRead == false && len(os.Args) == 2 {
-    filePath := os.Args[1]
-    extensionType := filepath.Ext(filePath)
-    if extensionType == ".json" {
-      fmt.Println("Reading input file: filePath")
-      jsonFile, err := os.Open(filePath)
-      if err != nil {
-          fmt.Println(err)
-      }
-      defer jsonFile.Close()
-      byteValue, _ := ioutil.ReadAll(jsonFile)
-      json.Unmarshal(byteValue, &document)
-
-    } else {
-      fmt.Println("Input file type not recognized")
-    }
-  } else if len(os.Args) == 1 {
-    fmt.Println("No input file: creating empty record")
+// *******************************
+// Main: serve a single document file, or all the documents
+// of a workspace directory
+// *******************************
+func main() {
+  if len(os.Args) > 1 && os.Args[1] == "adduser" {
+    os.Exit(runAddUser(os.Args[2:], os.Stdin))
+  }
+  if len(os.Args) > 1 && os.Args[1] == "merge" {
+    os.Exit(runMerge(os.Args[2:]))
+  }
+  if len(os.Args) > 1 && os.Args[1] == "convert" {
+    os.Exit(runConvert(os.Args[2:]))
   }
 
-  fmt.Println("Listening on localhost:"+port)
+  // Only this machine can connect unless the address is given
+  listen := flag.String("listen", "localhost:3000", "Address to listen on, :3000 accepts other machines")
+  flag.Parse()
+  args := flag.Args()
+
+  users, err := loadUserStore(usersFilePath())
+  if err != nil {
+    fmt.Println(err)
+    return
+  }
+  if len(users.Users) == 0 {
+    fmt.Println("No accounts yet, create the first one with: apunta adduser -admin <user>")
+  }
 
   // Serve assets folder
   fs := http.FileServer(http.Dir("assets"))
@@ -425,28 +677,73 @@ func main() {
 
   mux.Handle("/assets/", http.StripPrefix("/assets/", fs))
 
-  if len(os.Args) == 2 {
-    mux.HandleFunc("/writeJSON", document.writeJson(os.Args[1]))
+  mux.HandleFunc("/login", users.loginHandler())
+  mux.HandleFunc("/logout", users.logoutHandler())
+
+  if len(args) == 1 && isDir(args[0]) {
+    fmt.Println("Serving workspace: " + args[0])
+    workspace, err := openWorkspace(args[0], os.Getenv(passphraseEnv), users)
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    mux.Handle("/", workspace)
   } else {
-    currentTime := time.Now()
-    fileName := "apunta" + currentTime.Format("2006-01-02_150405.json")
-    mux.HandleFunc("/writeJSON", document.writeJson(fileName))
+    document, store, ok := loadInputDocument(args)
+    if !ok {
+      return
+    }
+    mux.Handle("/", document.routes(users, store))
   }
 
-  mux.HandleFunc("/addCategory", document.addCategory())
-  mux.HandleFunc("/addWho", document.addPayer())
-  mux.HandleFunc("/addCurrency", document.addCurrency())
-  mux.HandleFunc("/inputPreviousDebts", document.addPreviousDebts())
+  fmt.Println("Listening on " + *listen)
 
-  mux.HandleFunc("/changeSheet", document.changeToSheet())
+  if err := http.ListenAndServe(*listen, users.requireLogin(mux)); err != nil {
+    fmt.Println(err)
+  }
+}
 
-  mux.HandleFunc("/addSheet", document.addSheet())
-  mux.HandleFunc("/calcExchRateMonth", document.calcExchRate())
 
-  mux.HandleFunc("/addEntry", document.addEntry())
-  mux.HandleFunc("/", document.indexHandler())
+// *******************************
+// Document given in the command line, or an empty one,
+// with the storage it is saved to
+// *******************************
+func loadInputDocument(args []string) (*Document, Storage, bool) {
+  document := newDocument()
+  currentTime := time.Now()
+  fileName := "apunta" + currentTime.Format("2006-01-02_150405.json")
+  if len(args) == 1 {
+    fileName = args[0]
+  }
+  store, err := openStorage(fileName)
+  if err != nil {
+    fmt.Println(err)
+    return nil, nil, false
+  }
 
-  http.ListenAndServe(":"+port, mux)
+  // Check input file type
+  if inputFileRead == false && len(args) == 1 {
+    filePath := args[0]
+    extensionType := filepath.Ext(filePath)
+    if extensionType == ".json" || extensionType == sqliteExt {
+      fmt.Println("Reading input file: " + filePath)
+      doc, err := store.Load(os.Getenv(passphraseEnv))
+      if err != nil && !errors.Is(err, os.ErrNotExist) {
+        fmt.Println(err)
+        return nil, nil, false
+      } else if err == nil {
+        document = doc
+      }
+    } else {
+      fmt.Println("Input file type not recognized")
+    }
+  } else if len(args) == 0 {
+    fmt.Println("No input file: creating empty record")
+  }
 
-  fmt.Println("Listening on localhost:"+port)
+  // Setting a passphrase stores the document encrypted from the next save
+  if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+    document.passphrase = passphrase
+  }
+  return document, store, true
 }
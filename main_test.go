@@ -4,6 +4,26 @@ import (
 	"testing"
 	"fmt"
 	"time"
+	"io/ioutil"
+	"io"
+	"strings"
+	"encoding/xml"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"net/http"
+	"path/filepath"
+	"context"
+	"os/exec"
+	"os"
+	"errors"
+	"bytes"
+	"mime/multipart"
+	"archive/zip"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"apunta/exchRates/mockRates"
 )
 
 // Testing
@@ -28,9 +48,1921 @@ func BenchmarkIsSameMonthYear(b *testing.B) {
 }
 
 // Examples
-func ExampleIsSameMonthYear() {
+func Example_isSameMonthYear() {
 		date_a := time.Date(2021, time.Month(5), 24, 1, 2, 3, 4, time.Now().Location())
 		date_b := time.Date(2021, time.Month(5), 13, 5, 6, 7, 8, time.Now().Location())
     fmt.Println(isSameMonthYear(date_a, date_b))
     // Output: true
-}
\ No newline at end of file
+}
+
+func TestMergePayers(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	doc.PrevDebt = map[string]float64{"Ana": 10.0, "Bob": 5.0}
+	month := newMonthRec()
+	month.EntryRecords = []EntryRec{
+		{PersonName: "Ana", Amount: 20.0},
+		{PersonName: "Bob", Amount: 30.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+
+	if err := doc.mergePayers("Bob", "Ana"); err != nil {
+		t.Fatal(err)
+	}
+	doc.calcAllStats()
+
+	if doc.hasPayer("Bob") {
+		t.Errorf("Merged payer still in the list")
+	}
+	if doc.PrevDebt["Ana"] != 15.0 {
+		t.Errorf("Previous debt not merged, got %f", doc.PrevDebt["Ana"])
+	}
+	if _, ok := doc.MonthRecs[0].Stats.AllPayersStats["Bob"]; ok {
+		t.Errorf("Merged payer still in the statistics")
+	}
+	if spent := doc.MonthRecs[0].Stats.AllPayersStats["Ana"].Spent; spent != 50.0 {
+		t.Errorf("Expected 50.0 spent, got %f", spent)
+	}
+}
+
+func TestDeactivatePayer(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+
+	if err := doc.setPayerActive("Bob", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, payer := range doc.ActivePayers() {
+		if payer == "Bob" {
+			t.Errorf("Inactive payer offered as active")
+		}
+	}
+	if err := doc.renamePayer("Bob", "Robert"); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.IsInactivePayer("Robert") {
+		t.Errorf("Renamed payer lost its inactive state")
+	}
+}
+
+func TestSharedGroupStats(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob", "Kid"}
+	if err := doc.setGroup("couple", []string{"Ana", "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	month := newMonthRec()
+	month.EntryRecords = []EntryRec{
+		{PersonName: "Ana", Amount: 10.0},
+		{PersonName: "Bob", Amount: 10.0},
+		{PersonName: "Kid", Amount: 10.0},
+		{SharedGroup: "couple", Amount: 30.0},
+		{SharedGroup: defaultGroupName, Amount: 30.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+	doc.calcAllStats()
+
+	stats := doc.MonthRecs[0].Stats.AllPayersStats
+	if stats["Ana"].Spent != 35.0 || stats["Bob"].Spent != 35.0 {
+		t.Errorf("Couple expense not split between members: %v", stats)
+	}
+	if stats["Kid"].Spent != 20.0 {
+		t.Errorf("Expected 20.0 spent for Kid, got %f", stats["Kid"].Spent)
+	}
+}
+
+func TestMigrateSharedPayers(t *testing.T) {
+	doc := &Document{Payers: []string{"Ana", "All"}, LastUsedPayer: "All"}
+	month := newMonthRec()
+	month.EntryRecords = []EntryRec{
+		{PersonName: "All", Amount: 10.0},
+		{PersonName: "B", Amount: 10.0},
+		{PersonName: "Ana", Amount: 10.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+	doc.migrate()
+
+	if doc.hasPayer("All") {
+		t.Errorf("Legacy shared payer still in the list")
+	}
+	if _, ok := doc.findGroup(defaultGroupName); !ok {
+		t.Errorf("Default group not created")
+	}
+	for _, entry := range doc.MonthRecs[0].EntryRecords[:2] {
+		if entry.SharedGroup != defaultGroupName || entry.PersonName != "" {
+			t.Errorf("Legacy shared entry not migrated: %v", entry)
+		}
+	}
+	if doc.Version != documentVersion {
+		t.Errorf("Document version not updated")
+	}
+}
+
+// Document as written before payer groups and entry IDs existed
+const legacyDocument = `{
+ "PrevDebt": {"Ana": 0},
+ "Categories": ["Food", "Rent", "Gas"],
+ "Payers": ["Ana", "B", "All"],
+ "Currencies": ["EUR"],
+ "LastUsedPayer": "B",
+ "MonthRecs": [{
+  "StartDate": "2021-05-01T00:00:00Z",
+  "GroupName": "May",
+  "ActiveGroup": true,
+  "EntryRecords": [
+   {"Date": "2021-05-02T00:00:00Z", "Category": "Food", "PersonName": "Ana", "Currency": "EUR", "Amount": 10, "Comment": "Market"},
+   {"Date": "2021-05-03T00:00:00Z", "Category": "Rent", "PersonName": "B", "Currency": "EUR", "Amount": 500},
+   {"Date": "2021-05-04T00:00:00Z", "Category": "Gas", "PersonName": "All", "Currency": "EUR", "Amount": 30}
+  ]
+ }]
+}`
+
+func TestLoadLegacyDocument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.json")
+	if err := ioutil.WriteFile(path, []byte(legacyDocument), 0644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := loadDocument(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(doc.Payers, ",") != "Ana" || doc.LastUsedGroup != defaultGroupName {
+		t.Errorf("Legacy payers not migrated: %v", doc.Payers)
+	}
+	entries := doc.MonthRecs[0].EntryRecords
+	if len(entries) != 3 || entries[1].SharedGroup != defaultGroupName || entries[2].SharedGroup != defaultGroupName {
+		t.Fatalf("Legacy shared entries not migrated: %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.ID == "" {
+			t.Errorf("Entry without ID: %+v", entry)
+		}
+	}
+	if doc.Version != documentVersion {
+		t.Errorf("Document version not updated")
+	}
+}
+
+func TestMergeLegacyCopies(t *testing.T) {
+	dir := t.TempDir()
+	var copies []*Document
+	for _, name := range []string{"a.json", "b.json"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(legacyDocument), 0644)
+		doc, err := loadDocument(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, doc)
+	}
+	ours, theirs := copies[0], copies[1]
+	theirs.MonthRecs[0].EntryRecords = append(theirs.MonthRecs[0].EntryRecords,
+		EntryRec{ID: newEntryID(), Date: time.Date(2021, 5, 5, 0, 0, 0, 0, time.UTC), Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: 7})
+
+	result, err := mergeDocuments(nil, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || len(result.Conflicts) != 0 {
+		t.Errorf("Unexpected merge of legacy copies %+v", result)
+	}
+	merged, _ := result.build(nil)
+	var categories []string
+	for _, entry := range merged.MonthRecs[0].EntryRecords {
+		categories = append(categories, entry.Category)
+	}
+	if strings.Join(categories, ",") != "Food,Rent,Gas,Food" {
+		t.Errorf("Unexpected merged entries %v", categories)
+	}
+
+	// Copies never migrated can't be matched
+	ours.MonthRecs[0].EntryRecords[0].ID = ""
+	if _, err := mergeDocuments(nil, ours, theirs); err == nil {
+		t.Errorf("Entries without ID merged")
+	}
+}
+
+func TestMergeClosedSheets(t *testing.T) {
+	may := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(id string, amount float64) EntryRec {
+		return EntryRec{ID: id, Date: may.AddDate(0, 0, 2), Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: amount}
+	}
+	base := newDocument()
+	base.Payers = []string{"Ana", "Bob"}
+	base.MonthRecs = []MonthRec{*newCalendarMonthRec(may)}
+	base.MonthRecs[0].EntryRecords = []EntryRec{entry("e1", 10), entry("e2", 20)}
+	copyOf := func(doc *Document) *Document {
+		snapshot, _ := doc.snapshot()
+		copied, _ := fromSnapshot(snapshot)
+		return copied
+	}
+
+	// Ours closed the sheet while theirs kept editing it
+	ours := copyOf(base)
+	if err := ours.closeMonth(may.Format("2006-01")); err != nil {
+		t.Fatal(err)
+	}
+	frozen := ours.MonthRecs[0].Stats.AllPayersStats["Ana"].Spent
+	theirs := copyOf(base)
+	theirs.MonthRecs[0].EntryRecords[0].Amount = 15
+	theirs.MonthRecs[0].EntryRecords = append(theirs.MonthRecs[0].EntryRecords, entry("e3", 30))
+
+	for _, sides := range [][2]*Document{{ours, theirs}, {theirs, ours}} {
+		result, err := mergeDocuments(base, sides[0], sides[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Inboxed != 1 || result.Frozen != 1 || len(result.Conflicts) != 0 || result.ClosedNotice() == "" {
+			t.Errorf("Unexpected merge into a closed sheet %+v", result)
+		}
+		merged, _ := result.build(nil)
+		month := merged.MonthRecs[0]
+		if !month.Closed || len(month.EntryRecords) != 2 || month.EntryRecords[0].Amount != 10 {
+			t.Errorf("Closed sheet changed by the merge: %+v", month.EntryRecords)
+		}
+		if month.Stats.AllPayersStats["Ana"].Spent != frozen {
+			t.Errorf("Closed statistics changed by the merge: %v", month.Stats.AllPayersStats)
+		}
+		if len(merged.Inbox) != 1 || merged.Inbox[0].ID != "e3" {
+			t.Errorf("New entry of a closed sheet not in the inbox: %+v", merged.Inbox)
+		}
+	}
+}
+
+func TestIndexTemplate(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	month := newMonthRec()
+	month.GroupName = "2021-05"
+	month.ActiveGroup = true
+	month.StartDate = time.Date(2021, time.Month(5), 1, 0, 0, 0, 0, time.UTC)
+	month.EntryRecords = []EntryRec{
+		{Date: month.StartDate, PersonName: "Ana", Currency: "EUR", Amount: 10.0},
+		{Date: month.StartDate, SharedGroup: defaultGroupName, Currency: "CHF", Amount: 10.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+	doc.calcAllStats()
+
+	if err := tpl.Execute(ioutil.Discard, pageData{doc, &UserAccount{Name: "ana", Payer: "Ana"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaterializeRecurring(t *testing.T) {
+	doc := newDocument()
+	doc.Recurring = []RecurringEntry{
+		{Name: "Rent", Currency: "EUR", Amount: 800.0, DayOfMonth: 31, EveryMonths: 1,
+			StartDate: time.Date(2021, time.Month(1), 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "Insurance", Currency: "EUR", Amount: 90.0, DayOfMonth: 5, EveryMonths: 3,
+			StartDate: time.Date(2021, time.Month(1), 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	month := newMonthRec()
+	month.StartDate = time.Date(2021, time.Month(2), 1, 0, 0, 0, 0, time.UTC)
+	doc.materializeRecurring(month)
+	if len(month.EntryRecords) != 1 {
+		t.Fatalf("Expected 1 entry in February, got %d", len(month.EntryRecords))
+	}
+	if month.EntryRecords[0].Date.Day() != 28 {
+		t.Errorf("Day not moved to the end of the month: %s", month.EntryRecords[0].Date)
+	}
+
+	upcoming := doc.upcomingRecurring(time.Date(2021, time.Month(4), 2, 0, 0, 0, 0, time.UTC), 2)
+	if len(upcoming) != 3 {
+		t.Errorf("Expected 3 upcoming entries, got %d", len(upcoming))
+	}
+}
+
+func TestRenameInRecurring(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob", "Carl"}
+	doc.Groups = []PayerGroup{{Name: "Flat", Members: []string{"Ana", "Bob"}}}
+	doc.Recurring = []RecurringEntry{
+		{Name: "Gym", PersonName: "Bob", Currency: "EUR", Amount: 30.0, DayOfMonth: 1, EveryMonths: 1},
+		{Name: "Phone", PersonName: "Carl", Currency: "EUR", Amount: 20.0, DayOfMonth: 1, EveryMonths: 1},
+		{Name: "Rent", SharedGroup: "Flat", Currency: "EUR", Amount: 800.0, DayOfMonth: 1, EveryMonths: 1},
+	}
+
+	if err := doc.renamePayer("Bob", "Robert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.mergePayers("Carl", "Ana"); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.renameGroup("Flat", "Home"); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Recurring[0].PersonName != "Robert" || doc.Recurring[1].PersonName != "Ana" {
+		t.Errorf("Recurring payers not renamed: %+v", doc.Recurring)
+	}
+	if doc.Recurring[2].SharedGroup != "Home" {
+		t.Errorf("Recurring group not renamed: %+v", doc.Recurring[2])
+	}
+}
+
+func TestSearchEntries(t *testing.T) {
+	doc := newDocument()
+	month := newMonthRec()
+	month.GroupName = "2021-05"
+	month.AvgExchRates = []ExRateEntry{{"CHF", "EUR", 0.5}}
+	month.EntryRecords = []EntryRec{
+		{Date: time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC), Category: "House", Currency: "CHF", Amount: 100.0, Comment: "Plumber visit"},
+		{Date: time.Date(2021, time.Month(5), 9, 0, 0, 0, 0, time.UTC), Category: "House", Currency: "EUR", Amount: 40.0, Comment: "plumber parts"},
+		{Date: time.Date(2021, time.Month(5), 9, 0, 0, 0, 0, time.UTC), Category: "Food", Currency: "EUR", Amount: 20.0, Comment: "Groceries"},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+
+	result := doc.searchEntries(EntryFilter{Text: "PLUMBER"})
+	if len(result.Matches) != 2 || result.Total != 90.0 {
+		t.Errorf("Expected 2 matches totalling 90.0, got %d totalling %f", len(result.Matches), result.Total)
+	}
+
+	minAmount := 50.0
+	result = doc.searchEntries(EntryFilter{Category: "House", MinAmount: &minAmount})
+	if len(result.Matches) != 1 || result.CurrTotals["CHF"] != 100.0 {
+		t.Errorf("Amount filter not applied: %v", result.Matches)
+	}
+
+	if err := searchTpl.Execute(ioutil.Discard, result); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	for i, amount := range []float64{100.0, 150.0, 50.0} {
+		month := newMonthRec()
+		month.GroupName = fmt.Sprintf("2021-0%d", i+1)
+		month.StartDate = time.Date(2021, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC)
+		month.EntryRecords = []EntryRec{
+			{Date: month.StartDate, Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: amount},
+		}
+		doc.MonthRecs = append(doc.MonthRecs, *month)
+	}
+	doc.calcAllStats()
+
+	report := doc.buildReport(time.Date(2021, time.Month(2), 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, time.Month(12), 1, 0, 0, 0, 0, time.UTC))
+	if len(report.Months) != 2 || report.Total != 200.0 || report.MonthlyAverage != 100.0 {
+		t.Errorf("Unexpected report totals: %v", report)
+	}
+	if report.Months[1].Change != -100.0 {
+		t.Errorf("Expected -100.0 change, got %f", report.Months[1].Change)
+	}
+	if len(report.Categories) != 1 || report.Categories[0].Average != 100.0 {
+		t.Errorf("Unexpected category rows: %v", report.Categories)
+	}
+
+	if err := reportTpl.Execute(ioutil.Discard, report); err != nil {
+		t.Error(err)
+	}
+
+	// Sheets starting after the 1st of the last month are included
+	trip := newMonthRec()
+	trip.GroupName = "Trip"
+	trip.StartDate = time.Date(2021, time.Month(12), 10, 0, 0, 0, 0, time.UTC)
+	trip.EntryRecords = []EntryRec{{Date: trip.StartDate, Category: "Travel", PersonName: "Ana", Currency: "EUR", Amount: 70.0}}
+	doc.MonthRecs = append(doc.MonthRecs, *trip)
+	doc.calcAllStats()
+	req := httptest.NewRequest("GET", "/report?year=2021", nil)
+	report = doc.buildReport(parseReportRange(req))
+	if len(report.Months) != 4 || report.Months[3].GroupName != "Trip" || report.Total != 370.0 {
+		t.Errorf("Sheet starting mid-month missing from the yearly report: %+v", report.Months)
+	}
+	next := doc.buildReport(time.Date(2022, time.Month(1), 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.Month(12), 1, 0, 0, 0, 0, time.UTC))
+	if len(next.Months) != 0 {
+		t.Errorf("Sheets of another year in the report: %+v", next.Months)
+	}
+}
+
+func TestChartsSVG(t *testing.T) {
+	doc := newDocument()
+	month := newMonthRec()
+	month.GroupName = "<may>"
+	month.EntryRecords = []EntryRec{
+		{Category: "Food & drinks", PersonName: "Ana", Currency: "EUR", Amount: 30.0},
+		{Category: "House", PersonName: "Bob", Currency: "EUR", Amount: 10.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+	doc.calcAllStats()
+
+	charts := []string{
+		categoryPieSVG(&doc.MonthRecs[0], doc.RateMode),
+		payerBalanceSVG(&doc.MonthRecs[0]),
+		spendingTrendSVG(doc),
+	}
+	for _, svg := range charts {
+		decoder := xml.NewDecoder(strings.NewReader(svg))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Invalid SVG %s: %v", svg, err)
+			}
+		}
+	}
+	if !strings.Contains(charts[0], "Food &amp; drinks 30.00 (75%)") {
+		t.Errorf("Missing pie legend: %s", charts[0])
+	}
+
+	// Charts served after an edit show the new totals
+	doc.MonthRecs[0].EntryRecords = append(doc.MonthRecs[0].EntryRecords,
+		EntryRec{Category: "House", PersonName: "Carl", Currency: "EUR", Amount: 5.0})
+	doc.invalidateStats(0)
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, fileStorage{filepath.Join(t.TempDir(), "doc.json")})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/chart.svg?type=bars&sheet=%3Cmay%3E", nil))
+	if !strings.Contains(rec.Body.String(), ">Carl<") {
+		t.Errorf("Chart shows stale totals: %s", rec.Body.String())
+	}
+}
+
+func TestFindPeriodFor(t *testing.T) {
+	doc := newDocument()
+	may := newMonthRec()
+	may.GroupName = "2021-05"
+	may.StartDate = time.Date(2021, time.Month(5), 1, 0, 0, 0, 0, time.Local)
+	trip := newMonthRec()
+	trip.GroupName = "portugal"
+	trip.StartDate = time.Date(2021, time.Month(5), 28, 0, 0, 0, 0, time.Local)
+	trip.EndDate = time.Date(2021, time.Month(6), 3, 0, 0, 0, 0, time.Local)
+	doc.MonthRecs = append(doc.MonthRecs, *may, *trip)
+
+	cases := []struct {
+		date  time.Time
+		index int
+		ok    bool
+	}{
+		{time.Date(2021, time.Month(5), 1, 0, 0, 0, 0, time.UTC), 0, true},
+		{time.Date(2021, time.Month(5), 29, 0, 0, 0, 0, time.UTC), 1, true},
+		{time.Date(2021, time.Month(6), 3, 0, 0, 0, 0, time.UTC), 1, true},
+		{time.Date(2021, time.Month(6), 4, 0, 0, 0, 0, time.UTC), -1, false},
+	}
+	for _, c := range cases {
+		if index, ok := doc.findPeriodFor(c.date); index != c.index || ok != c.ok {
+			t.Errorf("Date %s placed in %d, expected %d", c.date, index, c.index)
+		}
+	}
+
+	// The active sheet is preferred on overlaps
+	doc.markMonthAsActive("2021-05")
+	if index, _ := doc.findPeriodFor(cases[1].date); index != 0 {
+		t.Errorf("Active sheet not preferred, got %d", index)
+	}
+}
+
+func TestPlaceEntryInbox(t *testing.T) {
+	doc := newDocument()
+	entry := EntryRec{Date: time.Date(2021, time.Month(7), 4, 0, 0, 0, 0, time.UTC), Currency: "EUR", Amount: 5.0}
+
+	if doc.placeEntry(entry, false) {
+		t.Errorf("Entry placed without sheets")
+	}
+	if len(doc.Inbox) != 1 || len(doc.Notices) != 1 {
+		t.Fatalf("Entry not moved to the inbox with a notice")
+	}
+
+	doc.insertSheet(newCalendarMonthRec(entry.Date))
+	if err := doc.assignInboxEntry(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Inbox) != 0 || len(doc.MonthRecs[0].EntryRecords) != 1 {
+		t.Errorf("Inbox entry not reassigned")
+	}
+
+	entry.Date = time.Date(2021, time.Month(8), 1, 0, 0, 0, 0, time.UTC)
+	if !doc.placeEntry(entry, true) || len(doc.MonthRecs) != 2 || doc.MonthRecs[1].GroupName != "2021-08" {
+		t.Errorf("Missing month not created")
+	}
+}
+
+func TestRenameInInbox(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	doc.Groups = []PayerGroup{{Name: "Flat", Members: []string{"Ana", "Bob"}}}
+	date := time.Date(2021, time.Month(7), 4, 0, 0, 0, 0, time.UTC)
+	doc.placeEntry(EntryRec{Date: date, PersonName: "Bob", Currency: "EUR", Amount: 5.0}, false)
+	doc.placeEntry(EntryRec{Date: date, SharedGroup: "Flat", Currency: "EUR", Amount: 7.0}, false)
+
+	if err := doc.renamePayer("Bob", "Robert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.renameGroup("Flat", "Home"); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Inbox[0].PersonName != "Robert" || doc.Inbox[1].SharedGroup != "Home" {
+		t.Fatalf("Inbox entries not renamed: %+v", doc.Inbox)
+	}
+
+	doc.insertSheet(newCalendarMonthRec(date))
+	if err := doc.assignInboxEntry(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if doc.MonthRecs[0].EntryRecords[0].PersonName != "Robert" {
+		t.Errorf("Inbox entry assigned under the old name")
+	}
+}
+
+func TestCloseMonth(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	for i := 1; i <= 2; i++ {
+		month := newCalendarMonthRec(time.Date(2021, time.Month(i), 1, 0, 0, 0, 0, time.UTC))
+		month.EntryRecords = []EntryRec{{PersonName: "Ana", Currency: "EUR", Amount: 10.0}}
+		doc.MonthRecs = append(doc.MonthRecs, *month)
+	}
+
+	if err := doc.closeMonth("2021-02"); err == nil {
+		t.Errorf("Month closed before the previous one")
+	}
+	if err := doc.closeMonth("2021-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes before the closed month do not alter its snapshot
+	doc.PrevDebt = map[string]float64{"Bob": 100.0}
+	doc.calcAllStats()
+	if debt := doc.MonthRecs[0].Stats.AllPayersStats["Bob"].Debt; debt != 0.0 {
+		t.Errorf("Closed month statistics recalculated, Bob debt %f", debt)
+	}
+
+	entry := EntryRec{Date: time.Date(2021, time.Month(1), 15, 0, 0, 0, 0, time.UTC), Currency: "EUR"}
+	if doc.placeEntry(entry, true) {
+		t.Errorf("Entry added to a closed month")
+	}
+	if err := doc.insertSheet(newCalendarMonthRec(time.Date(2020, time.Month(12), 1, 0, 0, 0, 0, time.UTC))); err == nil {
+		t.Errorf("Sheet added before a closed month")
+	}
+
+	// Merges and group renames would change closed entries and their totals
+	if err := doc.mergePayers("Ana", "Bob"); err == nil || len(doc.Payers) != 2 {
+		t.Errorf("Payer of a closed month merged")
+	}
+	if err := doc.renamePayer("Ana", "Anna"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.MonthRecs[0].Stats.AllPayersStats["Anna"]; !ok {
+		t.Errorf("Closed statistics not renamed: %v", doc.MonthRecs[0].Stats.AllPayersStats)
+	}
+	doc.MonthRecs[0].EntryRecords = append(doc.MonthRecs[0].EntryRecords, EntryRec{SharedGroup: defaultGroupName, Currency: "EUR", Amount: 4.0})
+	if err := doc.renameGroup(defaultGroupName, "Everyone"); err == nil {
+		t.Errorf("Group of a closed month renamed")
+	}
+	doc.MonthRecs[0].EntryRecords = doc.MonthRecs[0].EntryRecords[:1]
+	if err := doc.renameGroup(defaultGroupName, "Everyone"); err != nil {
+		t.Errorf("Group unused in closed months not renamed: %v", err)
+	}
+
+	if err := doc.reopenMonth("2021-01"); err != nil {
+		t.Fatal(err)
+	}
+	if debt := doc.MonthRecs[0].Stats.AllPayersStats["Bob"].Debt; debt != 110.0 {
+		t.Errorf("Reopened month not recalculated, Bob debt %f", debt)
+	}
+}
+
+func TestEditSheets(t *testing.T) {
+	doc := newDocument()
+	for i := 1; i <= 3; i++ {
+		month := newCalendarMonthRec(time.Date(2021, time.Month(i), 1, 0, 0, 0, 0, time.UTC))
+		month.EntryRecords = []EntryRec{
+			{Date: month.StartDate, PersonName: "Ana", Currency: "EUR", Amount: 10.0},
+			{Date: month.StartDate.AddDate(0, 0, 1), PersonName: "Bob", Currency: "EUR", Amount: 20.0},
+		}
+		doc.MonthRecs = append(doc.MonthRecs, *month)
+	}
+
+	if err := doc.renameSheet("2021-01", "2021-02"); err == nil {
+		t.Errorf("Sheet renamed to an existing name")
+	}
+	if err := doc.renameSheet("2021-01", "january"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := doc.moveEntries("january", "2021-02", []int{1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.MonthRecs[0].EntryRecords) != 1 || len(doc.MonthRecs[1].EntryRecords) != 3 {
+		t.Errorf("Entries not moved")
+	}
+
+	if err := doc.mergeSheets("2021-03", "2021-02"); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.MonthRecs) != 2 || len(doc.MonthRecs[1].EntryRecords) != 5 {
+		t.Errorf("Sheets not merged")
+	}
+	if end := doc.MonthRecs[1].PeriodEnd(); end.Month() != time.Month(3) || end.Day() != 31 {
+		t.Errorf("Merged period not extended, ends %s", end)
+	}
+
+	if err := doc.deleteSheet("january", false); err == nil {
+		t.Errorf("Sheet with entries deleted without confirmation")
+	}
+	if err := doc.deleteSheet("january", true); err != nil || len(doc.MonthRecs) != 1 {
+		t.Errorf("Sheet not deleted: %v", err)
+	}
+}
+
+// Synthetic document with the given number of months and entries per month
+func syntheticDocument(numMonths, numEntries int) *Document {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob", "Carla"}
+	for i := 0; i < numMonths; i++ {
+		month := newCalendarMonthRec(time.Date(2000, time.Month(1+i), 1, 0, 0, 0, 0, time.UTC))
+		for j := 0; j < numEntries; j++ {
+			entry := EntryRec{
+				Date:       month.StartDate.AddDate(0, 0, j%28),
+				Category:   "Food",
+				PersonName: doc.Payers[j%len(doc.Payers)],
+				Currency:   "EUR",
+				ExchRate:   1.0,
+				Amount:     float64(j%50) + 0.5,
+			}
+			if j%10 == 0 {
+				entry.PersonName = ""
+				entry.SharedGroup = defaultGroupName
+			}
+			month.EntryRecords = append(month.EntryRecords, entry)
+		}
+		doc.MonthRecs = append(doc.MonthRecs, *month)
+	}
+	return doc
+}
+
+func TestIncrementalStats(t *testing.T) {
+	doc := syntheticDocument(24, 30)
+	doc.calcAllStats()
+
+	// Change a month in the middle directly and only mark it as changed
+	doc.MonthRecs[12].EntryRecords[0].Amount += 300.0
+	doc.invalidateStats(12)
+	doc.calcAllStats()
+
+	full := syntheticDocument(24, 30)
+	full.MonthRecs[12].EntryRecords[0].Amount += 300.0
+	full.calcAllStats()
+
+	for index := range doc.MonthRecs {
+		for name, stats := range full.MonthRecs[index].Stats.AllPayersStats {
+			if doc.MonthRecs[index].Stats.AllPayersStats[name] != stats {
+				t.Fatalf("Month %d payer %s differs from full recalculation", index, name)
+			}
+		}
+		if !doc.MonthRecs[index].statsValid {
+			t.Errorf("Month %d left without valid statistics", index)
+		}
+	}
+}
+
+func BenchmarkCalcAllStatsFull(b *testing.B) {
+	doc := syntheticDocument(120, 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doc.invalidateAllStats()
+		doc.calcAllStats()
+	}
+}
+
+func BenchmarkCalcAllStatsLastMonth(b *testing.B) {
+	doc := syntheticDocument(120, 200)
+	doc.calcAllStats()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doc.invalidateStats(len(doc.MonthRecs) - 1)
+		doc.calcAllStats()
+	}
+}
+
+func BenchmarkCalcAllStatsUnchanged(b *testing.B) {
+	doc := syntheticDocument(120, 200)
+	doc.calcAllStats()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doc.calcAllStats()
+	}
+}
+
+func TestIncomeAndRefunds(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	month := newMonthRec()
+	month.EntryRecords = []EntryRec{
+		{ID: "a", Category: "House", PersonName: "Ana", Currency: "EUR", Amount: 100.0},
+		{ID: "b", Kind: kindRefund, RefundOf: "a", Category: "House", PersonName: "Ana", Currency: "EUR", Amount: 40.0},
+		{ID: "c", Kind: kindIncome, Category: "Furniture", SharedGroup: defaultGroupName, Currency: "EUR", Amount: 20.0},
+		{ID: "d", Category: "Food", PersonName: "Bob", Currency: "EUR", Amount: 50.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+	doc.calcAllStats()
+
+	stats := doc.MonthRecs[0].Stats.AllPayersStats
+	if stats["Ana"].Spent != 50.0 || stats["Bob"].Spent != 40.0 {
+		t.Errorf("Unexpected spent with income and refunds: %v", stats)
+	}
+
+	totals := doc.MonthRecs[0].categoryTotals(doc.RateMode)
+	if totals["House"] != 60.0 || totals["Furniture"] != 0.0 {
+		t.Errorf("Unexpected category totals: %v", totals)
+	}
+	if net := doc.MonthRecs[0].Net(doc.RateMode); net != -90.0 {
+		t.Errorf("Expected -90.0 net, got %f", net)
+	}
+	if refunded, ok := doc.findEntry("a"); !ok || refunded.Amount != 100.0 {
+		t.Errorf("Refunded entry not found")
+	}
+}
+
+func TestEntryRateModes(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana"}
+	month := newMonthRec()
+	month.AvgExchRates = []ExRateEntry{{"CHF", "EUR", 0.9}}
+	month.EntryRecords = []EntryRec{
+		{ID: "fetched", PersonName: "Ana", Currency: "CHF", ExchRate: 0.8, Amount: 100.0},
+		{ID: "manual", PersonName: "Ana", Currency: "CHF", ExchRate: 0.0, Amount: 100.0},
+	}
+	doc.MonthRecs = append(doc.MonthRecs, *month)
+
+	if err := doc.setEntryRate("manual", 0.95); err != nil {
+		t.Fatal(err)
+	}
+	doc.calcAllStats()
+	if spent := doc.MonthRecs[0].Stats.AllPayersStats["Ana"].Spent; math.Abs(spent - 185.0) > 1e-9 {
+		t.Errorf("Average mode: expected 185.0 spent, got %f", spent)
+	}
+
+	doc.RateMode = rateModeEntry
+	doc.invalidateAllStats()
+	doc.calcAllStats()
+	if spent := doc.MonthRecs[0].Stats.AllPayersStats["Ana"].Spent; math.Abs(spent - 175.0) > 1e-9 {
+		t.Errorf("Per-entry mode: expected 175.0 spent, got %f", spent)
+	}
+}
+
+func TestExchRatesCalcs(t *testing.T) {
+	mock := mockRates.NewServer()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	t.Setenv("OPEN_EXCHANGE_URL", server.URL+"/api")
+	t.Setenv("OPEN_EXCHANGE_APP_ID", "test")
+
+	month := newMonthRec()
+	days := []int{3, 4, 5, 6, 7, 10, 11}
+	for _, day := range days {
+		date := time.Date(2021, time.Month(5), day, 0, 0, 0, 0, time.UTC)
+		// Two entries per day share the downloaded rate
+		month.EntryRecords = append(month.EntryRecords,
+			EntryRec{Date: date, Currency: "CHF", Amount: 10.0},
+			EntryRec{Date: date, Currency: "CHF", Amount: 20.0},
+			EntryRec{Date: date, Currency: "EUR", ExchRate: 1.0, Amount: 5.0})
+	}
+	month.EntryRecords = append(month.EntryRecords,
+		EntryRec{Date: time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC), Currency: "XXX", Amount: 1.0},
+		EntryRec{Date: time.Date(2021, time.Month(5), 3, 0, 0, 0, 0, time.UTC), Currency: "CHF", ExchRate: 0.5, ManualRate: true, Amount: 1.0})
+
+	rates := month.ExchRatesCalcs()
+
+	// One request per currency and date
+	if requests := mock.Requests(); requests != len(days)+1 {
+		t.Errorf("Expected %d requests, got %d", len(days)+1, requests)
+	}
+
+	sum := 0.0
+	for _, entry := range month.EntryRecords {
+		switch {
+		case entry.ManualRate:
+			if entry.ExchRate != 0.5 {
+				t.Errorf("Manual rate overwritten: %f", entry.ExchRate)
+			}
+		case entry.Currency == "XXX":
+			if entry.ExchRate != 0.0 || entry.RateError == "" {
+				t.Errorf("Failed rate not marked: %f %s", entry.ExchRate, entry.RateError)
+			}
+		case entry.Currency == "CHF":
+			if entry.ExchRate < 0.9 || entry.ExchRate > 0.92 {
+				t.Errorf("Unexpected CHF rate on %s: %f", entry.Date, entry.ExchRate)
+			}
+			sum += entry.ExchRate
+		}
+	}
+
+	if len(rates) != 1 {
+		t.Fatalf("Expected average only for CHF, got %v", rates)
+	}
+	if missing := month.MissingRates(rateModeAverage); len(missing) != 1 || missing[0] != "XXX" {
+		t.Errorf("Expected XXX without rate, got %v", missing)
+	}
+	for _, rate := range rates {
+		if rate.CurrFrom == "CHF" && math.Abs(rate.AvgVal-sum/float64(2*len(days))) > 1e-9 {
+			t.Errorf("Unexpected CHF average %f", rate.AvgVal)
+		}
+	}
+
+	// Rates already downloaded are not requested again, failed ones are
+	month.ExchRatesCalcs()
+	if requests := mock.Requests(); requests != len(days)+2 {
+		t.Errorf("Rates requested again, %d requests", requests)
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	bcryptCost = bcrypt.MinCost
+	store, err := loadUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.addUser("ana", "secret", "Ana", false); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *UserAccount
+	handler := store.requireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = currentUser(r)
+	}))
+
+	// Without session the login page is shown
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/addEntry", nil))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("Request without session not redirected: %d", rec.Code)
+	}
+
+	if _, err := store.login("ana", "wrong"); err == nil {
+		t.Errorf("Login with wrong password")
+	}
+	token, err := store.login("ana", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/addEntry", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen == nil || seen.Payer != "Ana" {
+		t.Errorf("User not passed to the handler")
+	}
+
+	// Accounts are stored hashed and reloaded
+	reloaded, err := loadUserStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := reloaded.findUser("ana"); user == nil || user.PasswordHash == "secret" {
+		t.Errorf("Account not stored with hashed password")
+	}
+
+	store.logout(token)
+	if store.sessionUser(token) != nil {
+		t.Errorf("Session still open after logout")
+	}
+}
+
+func TestRenameLinkedPayer(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	users := &UserStore{path: usersPath, sessions: map[string]session{}, Users: []UserAccount{
+		{Name: "ana", Payer: "Ana"}, {Name: "bob", Payer: "Bob"}, {Name: "stranger", Payer: "Bob"},
+	}}
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob", "Carl"}
+	doc.setRole("ana", roleOwner)
+	doc.setRole("bob", roleMember)
+	doc.MonthRecs = []MonthRec{*newCalendarMonthRec(time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC))}
+	handler := doc.routes(users, fileStorage{filepath.Join(t.TempDir(), "doc.json")})
+	serve := func(user *UserAccount, path string) {
+		req := httptest.NewRequest("POST", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(users.findUser("ana"), "/renamePayer?oldPayer=Bob&newPayerName=Robert")
+	if users.findUser("bob").Payer != "Robert" || users.findUser("stranger").Payer != "Bob" {
+		t.Errorf("Linked accounts not renamed: %+v", users.Users)
+	}
+	saved, err := loadUserStore(usersPath)
+	if err != nil || saved.findUser("bob").Payer != "Robert" {
+		t.Errorf("Renamed link not saved: %v", err)
+	}
+	serve(users.findUser("bob"), "/addEntry?currency=EUR&quantity=5&who=Robert&date=2021-05-03")
+	if entries := doc.MonthRecs[0].EntryRecords; len(entries) != 1 || entries[0].PersonName != "Robert" {
+		t.Errorf("Member can't add entries after the rename: %+v", entries)
+	}
+
+	serve(users.findUser("ana"), "/mergePayers?fromPayer=Carl&intoPayer=Robert")
+	serve(users.findUser("ana"), "/mergePayers?fromPayer=Robert&intoPayer=Ana")
+	if users.findUser("bob").Payer != "Ana" {
+		t.Errorf("Linked account not moved to the merged payer: %+v", users.Users)
+	}
+}
+
+func TestAccountCreation(t *testing.T) {
+	bcryptCost = bcrypt.MinCost
+	path := filepath.Join(t.TempDir(), "users.json")
+	t.Setenv(usersFileEnv, path)
+	store, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The login page never creates accounts
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("user=mallory&password=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	store.loginHandler()(rec, req)
+	if len(store.Users) != 0 || !strings.Contains(rec.Body.String(), "apunta adduser -admin") {
+		t.Errorf("Account created from the login page")
+	}
+
+	// The first admin comes from the command line
+	if status := runAddUser([]string{"-admin", "-payer", "Ana", "ana"}, strings.NewReader("secret\n")); status != 0 {
+		t.Fatalf("adduser failed with status %d", status)
+	}
+	store, err = loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin := store.findUser("ana"); admin == nil || !admin.Admin || admin.Payer != "Ana" {
+		t.Fatalf("Admin not created: %+v", admin)
+	}
+	if _, err := store.login("ana", "secret"); err != nil {
+		t.Errorf("Admin can not log in: %v", err)
+	}
+
+	// Only admins create accounts, owners of documents do not
+	doc := newDocument()
+	doc.setRole("bob", roleOwner)
+	handler := doc.routes(store, fileStorage{filepath.Join(t.TempDir(), "doc.json")})
+	addUser := func(user *UserAccount, name string) {
+		req := httptest.NewRequest("POST", "/addUser?newUser=" + name + "&newUserPassword=pw", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	addUser(&UserAccount{Name: "bob"}, "eve")
+	if store.findUser("eve") != nil {
+		t.Errorf("Owner created an account")
+	}
+	addUser(store.findUser("ana"), "carl")
+	if carl := store.findUser("carl"); carl == nil || carl.Admin {
+		t.Errorf("Admin could not create a plain account: %+v", carl)
+	}
+
+	// Files without admins keep the first account as admin
+	store.Users[0].Admin = false
+	store.save()
+	if reloaded, err := loadUserStore(path); err != nil || !reloaded.Users[0].Admin || reloaded.Users[1].Admin {
+		t.Errorf("First account not made admin: %v", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	doc := newDocument()
+	doc.Payers = []string{"Ana", "Bob"}
+	owner := &UserAccount{Name: "ana", Payer: "Ana"}
+	member := &UserAccount{Name: "bob", Payer: "Bob"}
+	viewer := &UserAccount{Name: "accountant"}
+
+	if !doc.hasRole(viewer, roleOwner) {
+		t.Errorf("Documents without roles should be open")
+	}
+	for user, role := range map[string]string{"ana": roleOwner, "bob": roleMember, "accountant": roleViewer} {
+		if err := doc.setRole(user, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := doc.setRole("ana", roleViewer); err == nil {
+		t.Errorf("Last owner removed")
+	}
+
+	handler := doc.allow(roleMember, func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range []struct {
+		user *UserAccount
+		code int
+	}{{owner, http.StatusOK}, {member, http.StatusOK}, {viewer, http.StatusForbidden}, {&UserAccount{Name: "stranger"}, http.StatusForbidden}} {
+		req := httptest.NewRequest("POST", "/addEntry", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, c.user))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("User %s got %d, expected %d", c.user.Name, rec.Code, c.code)
+		}
+	}
+
+	own := EntryRec{PersonName: "Bob", CreatedBy: "bob"}
+	other := EntryRec{PersonName: "Ana", CreatedBy: "ana"}
+	legacy := EntryRec{PersonName: "Bob"}
+	if !doc.canEditEntry(member, own) || doc.canEditEntry(member, other) || !doc.canEditEntry(member, legacy) {
+		t.Errorf("Members must edit only their own entries")
+	}
+	if !doc.canEditEntry(owner, own) || doc.canEditEntry(viewer, own) {
+		t.Errorf("Unexpected entry permissions for owner or viewer")
+	}
+
+	// Only owners create missing sheets from the entry form
+	routes := doc.routes(&UserStore{sessions: map[string]session{}}, fileStorage{filepath.Join(t.TempDir(), "doc.json")})
+	addEntry := func(user *UserAccount, date string) {
+		req := httptest.NewRequest("POST", "/addEntry?autoCreate=on&currency=EUR&quantity=1&who=" + user.Payer + "&date=" + date, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
+		routes.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	addEntry(member, "2021-07-04")
+	if len(doc.MonthRecs) != 0 || len(doc.Inbox) != 1 {
+		t.Errorf("Member created a sheet: %d sheets, %d in inbox", len(doc.MonthRecs), len(doc.Inbox))
+	}
+	addEntry(owner, "2021-07-05")
+	if len(doc.MonthRecs) != 1 {
+		t.Errorf("Owner could not create a sheet")
+	}
+}
+
+func TestEncryptedDocument(t *testing.T) {
+	scryptN = 1 << 10
+	doc := newDocument()
+	doc.Categories = []string{"Groceries"}
+	doc.MonthRecs = append(doc.MonthRecs, MonthRec{StartDate: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)})
+	doc.passphrase = "correct horse"
+	path := filepath.Join(t.TempDir(), "doc.json")
+	if err := doc.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(data) || strings.Contains(string(data), "Groceries") {
+		t.Fatalf("Document stored in plain text")
+	}
+
+	if _, err := loadDocument(path, ""); err != ErrNoPassphrase {
+		t.Errorf("Expected missing passphrase error, got %v", err)
+	}
+	if _, err := loadDocument(path, "wrong"); err != ErrWrongPassphrase {
+		t.Errorf("Expected wrong passphrase error, got %v", err)
+	}
+	loaded, err := loadDocument(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Categories) != 1 || loaded.Categories[0] != "Groceries" || len(loaded.MonthRecs) != 1 {
+		t.Errorf("Document not restored: %+v", loaded)
+	}
+	if loaded.passphrase == "" {
+		t.Errorf("Loaded document must be saved encrypted again")
+	}
+
+	// Tampering with the ciphertext is detected
+	tampered := strings.Replace(string(data), `"Ciphertext": "`, `"Ciphertext": "AAAA`, 1)
+	if _, err := decryptDocument([]byte(tampered), "correct horse"); err != ErrWrongPassphrase {
+		t.Errorf("Tampered document accepted: %v", err)
+	}
+
+	// Key derivation parameters out of limits are rejected before deriving the key
+	var file encryptedFile
+	json.Unmarshal(data, &file)
+	for _, params := range [][3]int{{1 << 30, 8, 1}, {1000, 8, 1}, {1 << 16, 1 << 10, 1}, {1 << 10, 8, 1 << 20}, {1 << 20, 16, 1}} {
+		file.N, file.R, file.P = params[0], params[1], params[2]
+		crafted, _ := json.Marshal(file)
+		if _, err := decryptDocument(crafted, "correct horse"); err == nil || err == ErrWrongPassphrase {
+			t.Errorf("Parameters %v accepted: %v", params, err)
+		}
+	}
+
+	// Plain documents are still read as before
+	doc.passphrase = ""
+	if err := doc.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := loadDocument(path, ""); err != nil || loaded.passphrase != "" {
+		t.Errorf("Plain document not loaded: %v", err)
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	ws, err := openWorkspace(dir, "", &UserStore{sessions: map[string]session{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ana := &UserAccount{Name: "ana"}
+	bob := &UserAccount{Name: "bob"}
+	asUser := func(req *http.Request, user *UserAccount) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
+	}
+
+	if err := ws.create("house", ana); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.create("house", ana); err == nil {
+		t.Errorf("Duplicated document created")
+	}
+	if err := ws.create("../escape", ana); err == nil {
+		t.Errorf("Invalid document name accepted")
+	}
+
+	// Routes are scoped to each document
+	rec := httptest.NewRecorder()
+	ws.ServeHTTP(rec, asUser(httptest.NewRequest("POST", "/doc/house/addCategory?newCategory=Garden", nil), ana))
+	if rec.Code != http.StatusOK || ws.docs["house"].Categories[0] != "Garden" {
+		t.Fatalf("Category not added to the document: %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `action="/doc/house/addEntry"`) {
+		t.Errorf("Links not scoped to the document")
+	}
+	rec = httptest.NewRecorder()
+	ws.ServeHTTP(rec, asUser(httptest.NewRequest("GET", "/doc/missing/", nil), ana))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Unknown document served: %d", rec.Code)
+	}
+
+	// Only readable documents are listed
+	infos, err := ws.list(bob)
+	if err != nil || len(infos) != 0 {
+		t.Errorf("Bob must not see the document of Ana: %v %v", infos, err)
+	}
+
+	if err := ws.rename("house", "home", bob); err == nil {
+		t.Errorf("Non owner renamed the document")
+	}
+	if err := ws.rename("house", "home", ana); err != nil {
+		t.Fatal(err)
+	}
+	if ws.docs["home"].Base() != "/doc/home" {
+		t.Errorf("Document mounted at %s", ws.docs["home"].Base())
+	}
+
+	if err := ws.setArchived("home", true, ana); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDocument(filepath.Join(dir, archiveDir, "home.json"), ""); err != nil {
+		t.Errorf("Archived document not saved: %v", err)
+	}
+	infos, _ = ws.list(ana)
+	if len(infos) != 1 || !infos[0].Archived {
+		t.Errorf("Unexpected documents %+v", infos)
+	}
+	rec = httptest.NewRecorder()
+	ws.ServeHTTP(rec, asUser(httptest.NewRequest("GET", "/doc/home/", nil), ana))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Archived document served: %d", rec.Code)
+	}
+
+	if err := ws.setArchived("home", false, ana); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _, err := ws.document("home"); err != nil || doc.Categories[0] != "Garden" {
+		t.Errorf("Restored document lost its data: %v", err)
+	}
+
+	// Listing a fresh workspace reads no document, even unreadable ones
+	ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("not json"), 0644)
+	fresh, err := openWorkspace(dir, "", &UserStore{sessions: map[string]session{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = fresh.list(bob)
+	if err != nil || len(infos) != 2 || infos[0].Name != "broken" || infos[0].Role != "" || len(fresh.docs) != 0 {
+		t.Errorf("Unexpected fresh listing %+v %v", infos, err)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	doc := newDocument()
+	store := fileStorage{filepath.Join(t.TempDir(), "doc.json")}
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, store)
+	post := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec
+	}
+
+	post("/addCategory?newCategory=Food")
+	post("/addCategory?newCategory=Rent")
+	post("/changeSheet?sheetName=none")
+	if len(doc.Operations) != 2 {
+		t.Fatalf("Expected 2 operations, got %+v", doc.Operations)
+	}
+
+	post("/undo")
+	if len(doc.Categories) != 1 || doc.Categories[0] != "Food" {
+		t.Errorf("Undo failed: %v", doc.Categories)
+	}
+	post("/undo")
+	if len(doc.Categories) != 0 {
+		t.Errorf("Second undo failed: %v", doc.Categories)
+	}
+	if rec := post("/undo"); !strings.Contains(rec.Body.String(), "Nothing to undo") {
+		t.Errorf("Undo without operations must be reported")
+	}
+
+	post("/redo")
+	if len(doc.Categories) != 1 || doc.Categories[0] != "Food" {
+		t.Errorf("Redo failed: %v", doc.Categories)
+	}
+
+	// A new operation can't be mixed with the undone ones
+	post("/addCurrency?newCurrency=CHF")
+	if doc.History().CanRedo() {
+		t.Errorf("Redo must not be possible after a new operation")
+	}
+
+	ops := doc.Operations
+	names := []string{}
+	for _, op := range ops {
+		names = append(names, op.Name)
+	}
+	if strings.Join(names, ",") != "addCategory,addCategory,undo,undo,redo,addCurrency" {
+		t.Errorf("Unexpected log %v", names)
+	}
+	if !ops[1].Undone || ops[0].Undone || ops[4].Target != 1 {
+		t.Errorf("Unexpected operation state %+v", ops)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/history", nil))
+	if !strings.Contains(rec.Body.String(), "newCurrency=CHF") {
+		t.Errorf("Operation missing in history page")
+	}
+
+	// The log is saved with the document and can be undone after a restart
+	if err := store.Save(doc, ""); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Operations) != 6 || loaded.Operations[5].Changes == nil {
+		t.Fatalf("Operation log not saved: %+v", loaded.Operations)
+	}
+	if err := loaded.undoRedo(true, nil); err != nil || strings.Join(loaded.Currencies, ",") != "EUR" {
+		t.Errorf("Undo after reload failed: %v %v", loaded.Currencies, err)
+	}
+	if err := loaded.undoRedo(true, nil); err != nil || len(loaded.Categories) != 0 {
+		t.Errorf("Second undo after reload failed: %v %v", loaded.Categories, err)
+	}
+	if !loaded.Operations[0].Undone || len(loaded.Operations) != 8 {
+		t.Errorf("Unexpected reloaded log %+v", loaded.Operations)
+	}
+}
+
+func TestUndoChanges(t *testing.T) {
+	doc := newDocument()
+	doc.Categories = []string{"Food", "Rent"}
+	before, _ := doc.snapshot()
+	doc.Categories = []string{"Food", "Travel", "Rent"}
+	doc.RateMode = "monthly"
+	after, _ := doc.snapshot()
+
+	changes, err := diffSnapshots(before, after)
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("Unexpected changes %+v %v", changes, err)
+	}
+	if !changes[0].Splice || strings.Join(changes[0].Path, ".") != "Categories.1" || len(changes[0].Added) != 1 {
+		t.Errorf("Inserted category not found as a splice: %+v", changes[0])
+	}
+
+	// Later unrelated changes are kept by undo
+	doc.Currencies = append(doc.Currencies, "CHF")
+	current, _ := doc.snapshot()
+	reverted, err := applyChanges(current, changes, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undone, _ := fromSnapshot(reverted)
+	if strings.Join(undone.Categories, ",") != "Food,Rent" || undone.RateMode != "" || len(undone.Currencies) != 2 {
+		t.Errorf("Unexpected undone document %+v", undone)
+	}
+
+	// Removed items that changed since can not be restored
+	doc.Categories = []string{"Food", "Trips", "Rent"}
+	current, _ = doc.snapshot()
+	if _, err := applyChanges(current, changes, true); err == nil {
+		t.Errorf("Undo over changed items must fail")
+	}
+
+	// Values edited since are not overwritten
+	doc.Categories = []string{"Food", "Travel", "Rent"}
+	doc.RateMode = "daily"
+	current, _ = doc.snapshot()
+	if _, err := applyChanges(current, changes, true); err == nil || !strings.Contains(err.Error(), "RateMode") {
+		t.Errorf("Undo over a changed value must fail: %v", err)
+	}
+}
+
+func TestUndoShownSheet(t *testing.T) {
+	doc := newDocument()
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, fileStorage{filepath.Join(t.TempDir(), "doc.json")})
+	post := func(path string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec.Body.String()
+	}
+	shown := func() string {
+		names := []string{}
+		for _, month := range doc.MonthRecs {
+			if month.ActiveGroup {
+				names = append(names, month.GroupName)
+			}
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Changing the shown sheet is not recorded and doesn't block undo
+	post("/addSheet?monthYearSheet=2021-05")
+	post("/addSheet?monthYearSheet=2021-06")
+	post("/changeSheet?changeSheet=2021-05")
+	if len(doc.Operations) != 2 {
+		t.Fatalf("Expected 2 operations, got %+v", doc.Operations)
+	}
+	if body := post("/undo"); len(doc.MonthRecs) != 1 || shown() != "2021-05" || strings.Contains(body, "can not undo") {
+		t.Errorf("Undo after changing the sheet failed: %d sheets, %s shown", len(doc.MonthRecs), shown())
+	}
+	post("/redo")
+	if len(doc.MonthRecs) != 2 || shown() != "2021-05" {
+		t.Errorf("Redo changed the shown sheet: %d sheets, %s shown", len(doc.MonthRecs), shown())
+	}
+
+	// Removing the shown sheet shows the last one
+	post("/changeSheet?changeSheet=2021-06")
+	post("/undo")
+	if len(doc.MonthRecs) != 1 || shown() != "2021-05" {
+		t.Errorf("Undo of the shown sheet failed: %d sheets, %s shown", len(doc.MonthRecs), shown())
+	}
+	post("/changeSheet?changeSheet=none")
+	if body := post("/undo"); len(doc.MonthRecs) != 0 || strings.Contains(body, "can not undo") {
+		t.Errorf("Undo of the first sheet failed: %d sheets", len(doc.MonthRecs))
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	doc := newDocument()
+	doc.Categories = []string{"Food"}
+	doc.MonthRecs = append(doc.MonthRecs, MonthRec{GroupName: "May", StartDate: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)})
+	path := filepath.Join(t.TempDir(), "doc.json")
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, fileStorage{path})
+	ana := &UserAccount{Name: "ana"}
+	serve := func(h http.Handler, path string, user *UserAccount) {
+		req := httptest.NewRequest("POST", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	edit := func(name string, change func()) http.Handler {
+		return doc.record(name, func(w http.ResponseWriter, r *http.Request) { change() })
+	}
+
+	entry := EntryRec{ID: "e1", Date: time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC), Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: 42.1}
+	serve(edit("addEntry", func() { doc.MonthRecs[0].EntryRecords = append(doc.MonthRecs[0].EntryRecords, entry) }), "/addEntry", ana)
+	serve(edit("editEntry", func() { doc.MonthRecs[0].EntryRecords[0].Amount = 40 }), "/editEntry", ana)
+	serve(edit("renameCategory", func() { doc.Categories[0] = "Groceries" }), "/renameCategory", ana)
+	serve(handler, "/inputPreviousDebts?prevDebtName=Bob&prevDebtAmount=10", nil)
+	serve(edit("deleteEntry", func() { doc.MonthRecs[0].EntryRecords = nil }), "/deleteEntry", ana)
+
+	expected := []AuditEvent{
+		{User: "ana", Operation: "addEntry", Action: "entry added", Object: "e1", After: "2021-05-03 Food 42.10 EUR by Ana"},
+		{User: "ana", Operation: "editEntry", Action: "entry edited", Object: "e1", Field: "Amount", Before: "42.10", After: "40.00"},
+		{User: "ana", Operation: "renameCategory", Action: "category renamed", Object: "Food", Before: "Food", After: "Groceries"},
+		{Operation: "inputPreviousDebts", Action: "debt adjusted", Object: "Bob", After: "10.00"},
+		{User: "ana", Operation: "deleteEntry", Action: "entry deleted", Object: "e1", Before: "2021-05-03 Food 40.00 EUR by Ana"},
+	}
+	if len(doc.Audit) != len(expected) {
+		t.Fatalf("Unexpected audit log %+v", doc.Audit)
+	}
+	for index, event := range doc.Audit {
+		event.Time = time.Time{}
+		if event != expected[index] {
+			t.Errorf("Event %d is %+v, expected %+v", index, event, expected[index])
+		}
+	}
+
+	// Undoing is audited and doesn't remove the log
+	serve(handler, "/undo", ana)
+	last := doc.Audit[len(doc.Audit)-1]
+	if len(doc.Audit) != 6 || last.Operation != opUndo || last.Action != "entry added" {
+		t.Errorf("Undo not audited: %+v", doc.Audit)
+	}
+
+	if events := doc.filterAudit(AuditFilter{Action: "entry", User: "ana"}); len(events) != 4 || events[0].Operation != opUndo {
+		t.Errorf("Unexpected filtered events %+v", events)
+	}
+	if events := doc.filterAudit(AuditFilter{Text: "groceries"}); len(events) != 1 {
+		t.Errorf("Unexpected events with text %+v", events)
+	}
+	if events := doc.filterAudit(AuditFilter{ToDate: time.Now().AddDate(0, 0, -1).Truncate(24 * time.Hour)}); len(events) != 0 {
+		t.Errorf("Unexpected old events %+v", events)
+	}
+
+	// The log is stored with the document
+	if err := doc.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadDocument(path, "")
+	if err != nil || len(loaded.Audit) != 6 {
+		t.Errorf("Audit log not stored: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/audit?action=debt", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Bob") || strings.Contains(body, "Groceries</div>") {
+		t.Errorf("Unexpected audit page")
+	}
+}
+
+func TestMergeDocuments(t *testing.T) {
+	may := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(id string, amount float64) EntryRec {
+		return EntryRec{ID: id, Date: may.AddDate(0, 0, 2), Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: amount}
+	}
+	base := newDocument()
+	base.Categories = []string{"Food"}
+	base.Payers = []string{"Ana", "Bob"}
+	base.PrevDebt = map[string]float64{"Bob": 10}
+	base.MonthRecs = []MonthRec{{GroupName: "May", StartDate: may, EntryRecords: []EntryRec{entry("e1", 1), entry("e2", 2), entry("e3", 3)}}}
+	copyOf := func(doc *Document) *Document {
+		snapshot, _ := doc.snapshot()
+		copied, _ := fromSnapshot(snapshot)
+		return copied
+	}
+
+	ours := copyOf(base)
+	ours.Categories = append(ours.Categories, "Rent")
+	ours.MonthRecs[0].EntryRecords = []EntryRec{entry("e1", 10), entry("e2", 2), entry("e4", 4)}
+	ours.Audit = []AuditEvent{{Action: "entry edited", Object: "e1"}, {Action: "entry deleted", Object: "e3"}}
+
+	theirs := copyOf(base)
+	theirs.Categories = append(theirs.Categories, "Travel")
+	theirs.PrevDebt["Bob"] = 20
+	theirs.MonthRecs[0].EntryRecords = []EntryRec{entry("e1", 11), entry("e2", 20), entry("e3", 3), entry("e5", 5)}
+	june := entry("e6", 6)
+	june.Date = may.AddDate(0, 1, 1)
+	theirs.MonthRecs = append(theirs.MonthRecs, MonthRec{GroupName: "June", StartDate: may.AddDate(0, 1, 0), EntryRecords: []EntryRec{june}})
+	theirs.Audit = []AuditEvent{{Action: "entry edited", Object: "e1"}, {Action: "entry edited", Object: "e2"}}
+
+	amounts := func(doc *Document) map[string]float64 {
+		result := map[string]float64{}
+		for id, item := range entriesByID(doc) {
+			result[id+"@"+item.sheet] = item.entry.Amount
+		}
+		return result
+	}
+
+	result, err := mergeDocuments(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 || result.Deleted != 0 || result.Changed != 1 || len(result.Conflicts) != 1 || result.Conflicts[0].ID != "e1" {
+		t.Fatalf("Unexpected merge %+v", result)
+	}
+	merged, err := result.build(map[string]string{"entry:e1": mergeTheirs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"e1@May": 11, "e2@May": 20, "e4@May": 4, "e5@May": 5, "e6@June": 6}
+	if got := amounts(merged); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Merged entries %v, expected %v", got, expected)
+	}
+	if strings.Join(merged.Categories, ",") != "Food,Rent,Travel" || merged.PrevDebt["Bob"] != 20 {
+		t.Errorf("Unexpected merged settings %v %v", merged.Categories, merged.PrevDebt)
+	}
+
+	// Without base the audit logs tell which copy changed an entry
+	result, err = mergeDocuments(nil, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Conflicts) != 2 || result.Conflicts[1].Kind != "debt" {
+		t.Fatalf("Unexpected conflicts %+v", result.Conflicts)
+	}
+	merged, _ = result.build(nil)
+	expected = map[string]float64{"e1@May": 10, "e2@May": 20, "e4@May": 4, "e5@May": 5, "e6@June": 6}
+	if got := amounts(merged); fmt.Sprint(got) != fmt.Sprint(expected) || merged.PrevDebt["Bob"] != 10 {
+		t.Errorf("Merged entries %v, expected %v", got, expected)
+	}
+
+	// Command line, with the other copy in a database of another folder
+	// and a receipt that must be copied with the merge
+	dir := t.TempDir()
+	for name, doc := range map[string]*Document{"a.json": ours, "base.json": base} {
+		if err := doc.save(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receipt := strings.Repeat("ab", 32) + ".pdf"
+	theirs.MonthRecs[0].EntryRecords[3].Attachment = receipt
+	theirsDir := filepath.Join(dir, "theirs")
+	os.MkdirAll(filepath.Join(theirsDir, attachmentsDir), 0755)
+	ioutil.WriteFile(filepath.Join(theirsDir, attachmentsDir, receipt), []byte("%PDF-1.4"), 0644)
+	if err := (sqlStorage{filepath.Join(theirsDir, "b.db")}).Save(theirs, ""); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "merged.json")
+	code := runMerge([]string{"-base", filepath.Join(dir, "base.json"), "-o", output, "-prefer", "theirs", filepath.Join(dir, "a.json"), filepath.Join(theirsDir, "b.db")})
+	if code != 2 {
+		t.Errorf("Expected exit status 2 with conflicts, got %d", code)
+	}
+	written, err := loadDocument(output, "")
+	if err != nil || amounts(written)["e1@May"] != 11 {
+		t.Errorf("Merged file not written as expected: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, attachmentsDir, receipt)); err != nil {
+		t.Errorf("Receipt of the other copy not copied: %v", err)
+	}
+
+	// Web page: solve the conflicts and apply the merge as one operation
+	handler := ours.routes(&UserStore{sessions: map[string]session{}}, fileStorage{output})
+	ours.pendingMerge, _ = mergeDocuments(base, ours, theirs)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/merge", nil))
+	if !strings.Contains(rec.Body.String(), `name="entry:e1" value="theirs"`) {
+		t.Errorf("Conflict missing in merge page")
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/undo", nil))
+	if !strings.Contains(rec.Body.String(), "pending merge") || ours.pendingMerge == nil {
+		t.Errorf("Undo must wait for the pending merge")
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/applyMerge?entry:e1=theirs", nil))
+	if amounts(ours)["e1@May"] != 11 || len(ours.MonthRecs) != 2 || ours.pendingMerge != nil {
+		t.Errorf("Merge not applied: %v", amounts(ours))
+	}
+	if ops := ours.Operations; len(ops) != 1 || ops[0].Name != "merge" {
+		t.Errorf("Merge not recorded as an operation")
+	}
+
+	ours.pendingMerge, _ = mergeDocuments(base, ours, theirs)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/merge?cancel=on", nil))
+	if ours.pendingMerge != nil || !strings.Contains(rec.Body.String(), "Merge cancelled") {
+		t.Errorf("Merge not cancelled")
+	}
+}
+
+func TestGitStorage(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	store, err := newGitStorage(filepath.Join(dir, "doc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := newDocument()
+	doc.MonthRecs = []MonthRec{{GroupName: "May", StartDate: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)}}
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, store)
+	ana := &UserAccount{Name: "ana"}
+	serve := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userCtxKey, ana))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	edit := func(change func()) {
+		serve(doc.record("edit", func(w http.ResponseWriter, r *http.Request) { change() }), "/edit")
+	}
+
+	entry := EntryRec{ID: "e1", Date: time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC), Category: "Groceries", PersonName: "Ana", Currency: "EUR", Amount: 42.1}
+	edit(func() { doc.MonthRecs[0].EntryRecords = append(doc.MonthRecs[0].EntryRecords, entry) })
+	serve(handler, "/writeJSON")
+	serve(handler, "/writeJSON")
+	edit(func() { doc.MonthRecs[0].EntryRecords[0].Amount = 40 })
+	edit(func() { doc.Categories = append(doc.Categories, "Rent") })
+	serve(handler, "/writeJSON")
+
+	revisions, err := store.Revisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %+v", revisions)
+	}
+	if revisions[1].Message != "entry added: 2021-05-03 Groceries 42.10 EUR by Ana" || revisions[1].Author != "ana" {
+		t.Errorf("Unexpected first revision %+v", revisions[1])
+	}
+	if revisions[0].Message != "entry edited e1: Amount 42.10 -> 40.00 (and 1 more changes)" {
+		t.Errorf("Unexpected second revision %+v", revisions[0])
+	}
+	changes, err := store.Show(revisions[0].Hash)
+	if err != nil || !strings.Contains(changes, "category added: Rent by ana") || !strings.Contains(changes, `"Amount": 40,`) {
+		t.Errorf("Unexpected revision changes %q %v", changes, err)
+	}
+	if _, err := store.Show("HEAD; rm -rf /"); err == nil {
+		t.Errorf("Invalid revision accepted")
+	}
+
+	rec := serve(handler, "/revisions")
+	if !strings.Contains(rec.Body.String(), "entry added: 2021-05-03 Groceries 42.10 EUR by Ana") {
+		t.Errorf("Revision missing in page")
+	}
+
+	// Documents moved in a workspace are committed too
+	t.Setenv(storageEnv, "git")
+	ws, err := openWorkspace(filepath.Join(dir, "books"), "", &UserStore{sessions: map[string]session{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.create("house", ana); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.rename("house", "home", ana); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.setArchived("home", true, ana); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ws.git.git("log", "--format=%s", "--name-status")
+	if err != nil || !strings.Contains(out, "move document home.json to archive/home.json") || !strings.Contains(out, "move document house.json to home.json") {
+		t.Errorf("Unexpected workspace log %q %v", out, err)
+	}
+	if status, _ := ws.git.git("status", "--porcelain", "--", "."); strings.TrimSpace(status) != "" {
+		t.Errorf("Workspace changes not committed: %q", status)
+	}
+	// The workspace is inside the repository of the first document,
+	// but gets its own
+	if top, _ := ws.git.git("rev-parse", "--show-toplevel"); !strings.HasSuffix(strings.TrimSpace(top), "books") {
+		t.Errorf("Parent repository reused: %q", top)
+	}
+	if out, _ := store.git("log", "--format=%s"); strings.Contains(out, "move document") {
+		t.Errorf("Workspace committed into the parent repository: %q", out)
+	}
+
+	// Commits of encrypted documents don't tell the values
+	os.Mkdir(filepath.Join(dir, "secret"), 0755)
+	secretStore, err := newGitStorage(filepath.Join(dir, "secret", "doc.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := newDocument()
+	secret.passphrase = "long secret"
+	secret.MonthRecs = []MonthRec{{GroupName: "May", StartDate: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)}}
+	secretHandler := secret.routes(&UserStore{sessions: map[string]session{}}, secretStore)
+	serve(secret.record("edit", func(w http.ResponseWriter, r *http.Request) {
+		secret.MonthRecs[0].EntryRecords = append(secret.MonthRecs[0].EntryRecords, entry)
+	}), "/edit")
+	serve(secret.record("edit", func(w http.ResponseWriter, r *http.Request) {
+		secret.MonthRecs[0].EntryRecords[0].Amount = 40
+	}), "/edit")
+	serve(secretHandler, "/writeJSON")
+	out, err = secretStore.git("log", "--format=%B")
+	if err != nil || !strings.Contains(out, "entry added (and 1 more changes)") || !strings.Contains(out, "entry edited: Amount by ana") {
+		t.Errorf("Unexpected encrypted commit %q %v", out, err)
+	}
+	if strings.Contains(out, "42.10") || strings.Contains(out, "Groceries") || strings.Contains(out, "Ana") {
+		t.Errorf("Encrypted commit tells values: %q", out)
+	}
+}
+
+func TestSqlStorage(t *testing.T) {
+	dir := t.TempDir()
+	may := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	doc := newDocument()
+	doc.Categories = []string{"Food", "Rent"}
+	doc.Payers = []string{"Ana", "Bob", "Carl"}
+	doc.InactivePayers = []string{"Carl"}
+	doc.Currencies = []string{"EUR", "USD"}
+	doc.PrevDebt = map[string]float64{"Bob": 12.5}
+	doc.setRole("ana", roleOwner)
+	doc.MonthRecs = []MonthRec{{
+		GroupName:    "May",
+		StartDate:    may,
+		Closed:       true,
+		ClosedDate:   may.AddDate(0, 1, 0),
+		AvgExchRates: []ExRateEntry{{CurrFrom: "USD", CurrTo: "EUR", AvgVal: 0.9}},
+		EntryRecords: []EntryRec{
+			{ID: "e1", Date: may.AddDate(0, 0, 2), Category: "Food", PersonName: "Ana", Currency: "EUR", Amount: 42.1, Comment: "market"},
+			{ID: "e2", Date: may.AddDate(0, 0, 3), Category: "Rent", PersonName: "Bob", Currency: "USD", ExchRate: 0.9, ManualRate: true, Amount: 500},
+		},
+	}}
+	doc.Inbox = []EntryRec{{ID: "e3", Date: may.AddDate(0, 0, 4), Category: "Food", PersonName: "Carl", Currency: "EUR", Amount: 3, CreatedBy: "bob"}}
+	doc.Audit = []AuditEvent{{User: "ana", Action: "entry added", Object: "e1"}}
+
+	jsonPath := filepath.Join(dir, "doc.json")
+	if err := doc.save(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "doc.db")
+	if status := runConvert([]string{jsonPath, dbPath}); status != 0 {
+		t.Fatalf("Import failed with status %d", status)
+	}
+	backPath := filepath.Join(dir, "back.json")
+	if status := runConvert([]string{dbPath, backPath}); status != 0 {
+		t.Fatalf("Export failed with status %d", status)
+	}
+
+	fromJson, err := loadDocument(jsonPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDb, err := sqlStorage{dbPath}.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := loadDocument(backPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := fromJson.encode()
+	for name, loaded := range map[string]*Document{"database": fromDb, "exported file": exported} {
+		if got, _ := loaded.encode(); string(got) != string(want) {
+			t.Errorf("The %s differs from the original:\n%s\n%s", name, got, want)
+		}
+	}
+
+	// Saving again replaces the rows
+	fromDb.MonthRecs[0].EntryRecords = fromDb.MonthRecs[0].EntryRecords[:1]
+	fromDb.Inbox = nil
+	if err := (sqlStorage{dbPath}).Save(fromDb, "ana"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := sqlStorage{dbPath}.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.MonthRecs[0].EntryRecords) != 1 || len(reloaded.Inbox) != 0 {
+		t.Errorf("Unexpected entries after saving %+v %+v", reloaded.MonthRecs[0].EntryRecords, reloaded.Inbox)
+	}
+
+	// Missing databases are reported as not existing, and can not be encrypted
+	if _, err := (sqlStorage{filepath.Join(dir, "missing.db")}).Load(""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected missing database, got %v", err)
+	}
+	t.Setenv(storageEnv, "sqlite")
+	store, err := openStorage(jsonPath)
+	if err != nil || store.String() != dbPath {
+		t.Errorf("Unexpected storage %v %v", store, err)
+	}
+	t.Setenv(passphraseEnv, "secret")
+	if _, err := openStorage(dbPath); err == nil {
+		t.Errorf("Encrypted SQLite storage accepted")
+	}
+
+	// Encrypted documents are only converted into plain databases on request
+	secretPath := filepath.Join(dir, "secret.json")
+	doc.passphrase = "secret"
+	if err := doc.save(secretPath); err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(dir, "plain.db")
+	if status := runConvert([]string{secretPath, plainPath}); status != 1 {
+		t.Errorf("Encrypted document converted into a plain database")
+	}
+	if _, err := os.Stat(plainPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Plain database written: %v", err)
+	}
+	if status := runConvert([]string{"-allow-plaintext", secretPath, plainPath}); status != 0 {
+		t.Errorf("Conversion with -allow-plaintext failed with status %d", status)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	dir := t.TempDir()
+	doc := newDocument()
+	doc.Categories = []string{"Food"}
+	doc.Payers = []string{"Ana"}
+	doc.MonthRecs = []MonthRec{{GroupName: "May", ActiveGroup: true, StartDate: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2021, 5, 31, 0, 0, 0, 0, time.UTC)}}
+	jsonPath := filepath.Join(dir, "doc.json")
+	handler := doc.routes(&UserStore{sessions: map[string]session{}}, fileStorage{jsonPath})
+	receipt := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	upload := func(content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for key, value := range map[string]string{"date": "2021-05-03", "category": "Food", "who": "Ana", "currency": "EUR", "quantity": "12.5"} {
+			form.WriteField(key, value)
+		}
+		file, _ := form.CreateFormFile("receipt", "receipt.png")
+		file.Write(content)
+		form.Close()
+		req := httptest.NewRequest("POST", "/addEntry", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	upload(receipt)
+	upload(receipt)
+	entries := doc.MonthRecs[0].EntryRecords
+	if len(entries) != 2 || entries[0].Attachment == "" || entries[0].Attachment != entries[1].Attachment {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	name := entries[0].Attachment
+	if !strings.HasSuffix(name, ".png") || !entries[0].HasImage() {
+		t.Errorf("Unexpected attachment name %s", name)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, attachmentsDir)); len(files) != 1 {
+		t.Errorf("The same receipt must be stored once, got %d files", len(files))
+	}
+	if rec := upload([]byte("plain text")); !strings.Contains(rec.Body.String(), "Receipts must be") || len(doc.MonthRecs[0].EntryRecords) != 2 {
+		t.Errorf("Text receipt accepted")
+	}
+
+	if rec := get("/"); !strings.Contains(rec.Body.String(), `class="receipt-thumb" src="/attachment?name=` + name) {
+		t.Errorf("Thumbnail missing in entry table")
+	}
+	if rec := get("/attachment?name=" + name); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), receipt) {
+		t.Errorf("Attachment not served: %d", rec.Code)
+	}
+	if rec := get("/attachment?name=../doc.json"); rec.Code != http.StatusNotFound {
+		t.Errorf("Invalid attachment name served: %d", rec.Code)
+	}
+
+	// Backups include the receipts
+	rec := get("/backup")
+	backup, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, file := range backup.File {
+		files = append(files, file.Name)
+	}
+	if strings.Join(files, " ") != "apunta.json attachments/" + name {
+		t.Errorf("Unexpected backup files %v", files)
+	}
+
+	// Exports copy the receipts next to the new file
+	if err := doc.save(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "export", "doc.db")
+	os.Mkdir(filepath.Dir(dbPath), 0755)
+	if status := runConvert([]string{jsonPath, dbPath}); status != 0 {
+		t.Fatalf("Export failed with status %d", status)
+	}
+	exported, err := sqlStorage{dbPath}.Load("")
+	if err != nil || exported.MonthRecs[0].EntryRecords[0].Attachment != name {
+		t.Fatalf("Attachment not exported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "export", attachmentsDir, name)); err != nil {
+		t.Errorf("Receipt not copied: %v", err)
+	}
+
+	// Receipts of encrypted documents are encrypted, also those stored before
+	scryptN = 1 << 10
+	doc.passphrase = "secret"
+	if err := doc.save(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadFile(filepath.Join(dir, attachmentsDir, name))
+	if !isEncrypted(stored) || bytes.Contains(stored, receipt[:8]) {
+		t.Errorf("Receipt stored before the passphrase not encrypted")
+	}
+	pdf := []byte("%PDF-1.4 secret receipt")
+	upload(pdf)
+	pdfName := doc.MonthRecs[0].EntryRecords[2].Attachment
+	stored, _ = ioutil.ReadFile(filepath.Join(dir, attachmentsDir, pdfName))
+	if !isEncrypted(stored) || bytes.Contains(stored, []byte("secret receipt")) {
+		t.Errorf("Uploaded receipt not encrypted")
+	}
+	if rec := get("/attachment?name=" + pdfName); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), pdf) {
+		t.Errorf("Encrypted attachment not served: %d", rec.Code)
+	}
+
+	// Receipts don't wait for the requests changing the document
+	doc.mutex.Lock()
+	served := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/attachment?name=" + pdfName, nil)
+		doc.attachmentHandler()(rec, req)
+		served <- rec.Code
+	}()
+	select {
+	case <-served:
+		t.Errorf("Receipt decrypted while holding the document lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	doc.mutex.Unlock()
+	if code := <-served; code != http.StatusOK {
+		t.Errorf("Receipt not served after the lock: %d", code)
+	}
+	doc.setRole("ana", roleOwner)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/attachment?name=" + pdfName, nil)
+	req = req.WithContext(context.WithValue(req.Context(), userCtxKey, &UserAccount{Name: "bob"}))
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Receipt served without a role: %d", rec.Code)
+	}
+
+	// Plain copies get plain receipts
+	if err := doc.save(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(passphraseEnv, "secret")
+	plainPath := filepath.Join(dir, "plain", "doc.db")
+	os.Mkdir(filepath.Dir(plainPath), 0755)
+	if status := runConvert([]string{"-allow-plaintext", jsonPath, plainPath}); status != 0 {
+		t.Fatalf("Plain export failed with status %d", status)
+	}
+	if copied, _ := ioutil.ReadFile(filepath.Join(dir, "plain", attachmentsDir, pdfName)); !bytes.Equal(copied, pdf) {
+		t.Errorf("Receipt not decrypted for the plain copy")
+	}
+}
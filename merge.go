@@ -0,0 +1,692 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "html/template"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+)
+
+const (
+  mergeOurs   = "ours"
+  mergeTheirs = "theirs"
+)
+
+var mergeTpl = template.Must(template.ParseFiles("merge.html"))
+
+// Value changed differently in both copies, resolved by hand
+// An empty description means the value was deleted in that copy
+type MergeConflict struct {
+  Kind     string
+  ID       string
+  Ours     string
+  Theirs   string
+
+  resolve  func(doc *Document, theirs bool)
+}
+
+// Result of merging two copies of a document, before solving the conflicts
+// Closed sheets keep their entries, so their frozen statistics match:
+// new entries for them go to the inbox and changes to them are dropped
+type MergeResult struct {
+  Added      int
+  Deleted    int
+  Changed    int
+  Inboxed    int
+  Frozen     int
+  Conflicts  []MergeConflict
+
+  doc        *Document
+  entries    []auditEntry
+}
+
+
+// *******************************
+// Changes of the merge left out of closed sheets, empty if none
+// *******************************
+func (result *MergeResult) ClosedNotice() string {
+  if result.Inboxed == 0 && result.Frozen == 0 {
+    return ""
+  }
+  return fmt.Sprintf("Closed sheets are kept: %d entries for them moved to the inbox, %d changes to their entries ignored",
+    result.Inboxed, result.Frozen)
+}
+
+
+// *******************************
+// Check if two versions of an entry are the same, nil if missing
+// *******************************
+func sameEntry(a, b *auditEntry) bool {
+  if a == nil || b == nil {
+    return a == nil && b == nil
+  }
+  aFields := entryFields(*a)
+  bFields := entryFields(*b)
+  if len(aFields) != len(bFields) {
+    return false
+  }
+  for field, value := range aFields {
+    if bFields[field] != value {
+      return false
+    }
+  }
+  return true
+}
+
+
+// *******************************
+// Entries edited or deleted in a copy, according to its audit log
+// *******************************
+func auditedEntries(doc *Document, action string) map[string]bool {
+  ids := map[string]bool{}
+  for _, event := range doc.Audit {
+    if event.Action == action {
+      ids[event.Object] = true
+    }
+  }
+  return ids
+}
+
+
+// *******************************
+// Common version of the entries when no base copy is given:
+// entries only edited or deleted in one copy, according to
+// its audit log, take the version of the other copy
+// *******************************
+func inferBaseEntries(ours, theirs *Document) map[string]auditEntry {
+  base := map[string]auditEntry{}
+  ourEntries := entriesByID(ours)
+  theirEntries := entriesByID(theirs)
+  ourEdits := auditedEntries(ours, "entry edited")
+  theirEdits := auditedEntries(theirs, "entry edited")
+  ourDeletes := auditedEntries(ours, "entry deleted")
+  theirDeletes := auditedEntries(theirs, "entry deleted")
+
+  for id, our := range ourEntries {
+    their, ok := theirEntries[id]
+    switch {
+    case !ok && theirDeletes[id]:
+      base[id] = our
+    case !ok:
+    case sameEntry(&our, &their):
+      base[id] = our
+    case ourEdits[id] && !theirEdits[id]:
+      base[id] = their
+    case theirEdits[id] && !ourEdits[id]:
+      base[id] = our
+    }
+  }
+  for id, their := range theirEntries {
+    if _, ok := ourEntries[id]; !ok && ourDeletes[id] {
+      base[id] = their
+    }
+  }
+  return base
+}
+
+
+// *******************************
+// Union of two lists of names, keeping the order of the first
+// *******************************
+func unionStr(ours, theirs []string) []string {
+  result := append([]string{}, ours...)
+  for _, name := range theirs {
+    if !containsStr(result, name) {
+      result = append(result, name)
+    }
+  }
+  return result
+}
+
+
+// *******************************
+// Settings of both copies: names are joined, and ours are
+// kept when the same setting differs
+// *******************************
+func mergeSettings(doc, theirs *Document) {
+  doc.Categories = unionStr(doc.Categories, theirs.Categories)
+  doc.Payers = unionStr(doc.Payers, theirs.Payers)
+  doc.InactivePayers = unionStr(doc.InactivePayers, theirs.InactivePayers)
+  doc.Currencies = unionStr(doc.Currencies, theirs.Currencies)
+
+  for _, group := range theirs.Groups {
+    if index, ok := doc.findGroup(group.Name); ok {
+      doc.Groups[index].Members = unionStr(doc.Groups[index].Members, group.Members)
+    } else {
+      doc.Groups = append(doc.Groups, group)
+    }
+  }
+
+  names := []string{}
+  for _, recurring := range doc.Recurring {
+    names = append(names, recurring.Name)
+  }
+  for _, recurring := range theirs.Recurring {
+    if !containsStr(names, recurring.Name) {
+      doc.Recurring = append(doc.Recurring, recurring)
+    }
+  }
+
+  for user, role := range theirs.Roles {
+    if _, ok := doc.Roles[user]; !ok {
+      if doc.Roles == nil {
+        doc.Roles = map[string]string{}
+      }
+      doc.Roles[user] = role
+    }
+  }
+
+  // Sheets are matched by name, closing one in any copy closes it
+  for _, month := range theirs.MonthRecs {
+    index := -1
+    for ourIndex := range doc.MonthRecs {
+      if doc.MonthRecs[ourIndex].GroupName == month.GroupName {
+        index = ourIndex
+      }
+    }
+    if index < 0 {
+      doc.MonthRecs = append(doc.MonthRecs, month)
+    } else if month.Closed && !doc.MonthRecs[index].Closed {
+      doc.MonthRecs[index] = month
+    }
+  }
+  // Entries are placed again by the merge, except those of closed
+  // sheets that match their statistics
+  for index := range doc.MonthRecs {
+    if !doc.MonthRecs[index].Closed {
+      doc.MonthRecs[index].EntryRecords = nil
+    }
+    doc.MonthRecs[index].ActiveGroup = false
+  }
+  doc.Inbox = nil
+  doc.sortMonthsByDate()
+
+  // Audit logs are joined in time order
+  seen := map[AuditEvent]bool{}
+  audit := []AuditEvent{}
+  for _, event := range append(append([]AuditEvent{}, doc.Audit...), theirs.Audit...) {
+    if !seen[event] {
+      seen[event] = true
+      audit = append(audit, event)
+    }
+  }
+  sort.SliceStable(audit, func(i, j int) bool { return audit[i].Time.Before(audit[j].Time) })
+  doc.Audit = audit
+}
+
+
+// *******************************
+// Three-way merge of two copies of a document
+// Without base, the common version is guessed from the audit logs
+// *******************************
+func mergeDocuments(base, ours, theirs *Document) (*MergeResult, error) {
+  // Entries are matched by ID, those without one can't be told apart
+  for _, side := range []*Document{base, ours, theirs} {
+    if side == nil {
+      continue
+    }
+    if _, ok := entriesByID(side)[""]; ok {
+      return nil, fmt.Errorf("Entries without ID can not be merged, open and save the copies first")
+    }
+  }
+  snapshot, err := ours.snapshot()
+  if err != nil {
+    return nil, err
+  }
+  doc, err := fromSnapshot(snapshot)
+  if err != nil {
+    return nil, err
+  }
+  doc.Audit = ours.Audit
+  doc.Operations = ours.Operations
+  doc.passphrase = ours.passphrase
+  mergeSettings(doc, theirs)
+  result := &MergeResult{doc: doc}
+
+  var baseEntries map[string]auditEntry
+  if base != nil {
+    baseEntries = entriesByID(base)
+  } else {
+    baseEntries = inferBaseEntries(ours, theirs)
+  }
+  ourEntries := entriesByID(ours)
+  theirEntries := entriesByID(theirs)
+  frozenEntries := map[string]auditEntry{}
+  closedSheets := map[string]bool{}
+  for _, month := range doc.MonthRecs {
+    if month.Closed {
+      closedSheets[month.GroupName] = true
+      for _, entry := range month.EntryRecords {
+        frozenEntries[entry.ID] = auditEntry{entry, month.GroupName}
+      }
+    }
+  }
+
+  // Ours first, in their order, then the new ones of theirs
+  ids := []string{}
+  for _, month := range ours.MonthRecs {
+    for _, entry := range month.EntryRecords {
+      ids = append(ids, entry.ID)
+    }
+  }
+  for _, entry := range ours.Inbox {
+    ids = append(ids, entry.ID)
+  }
+  for _, month := range theirs.MonthRecs {
+    for _, entry := range month.EntryRecords {
+      if _, ok := ourEntries[entry.ID]; !ok {
+        ids = append(ids, entry.ID)
+      }
+    }
+  }
+  for _, entry := range theirs.Inbox {
+    if _, ok := ourEntries[entry.ID]; !ok {
+      ids = append(ids, entry.ID)
+    }
+  }
+
+  version := func(entries map[string]auditEntry, id string) *auditEntry {
+    if item, ok := entries[id]; ok {
+      return &item
+    }
+    return nil
+  }
+  for _, id := range ids {
+    our := version(ourEntries, id)
+    their := version(theirEntries, id)
+    common := version(baseEntries, id)
+    if frozen := version(frozenEntries, id); frozen != nil {
+      if !sameEntry(frozen, our) || !sameEntry(frozen, their) {
+        result.Frozen++
+      }
+      continue
+    }
+
+    var merged *auditEntry
+    switch {
+    case sameEntry(our, their), sameEntry(their, common):
+      merged = our
+    case sameEntry(our, common):
+      merged = their
+    default:
+      result.Conflicts = append(result.Conflicts, entryConflict(id, our, their))
+      continue
+    }
+
+    switch {
+    case merged != nil && our == nil:
+      result.Added++
+    case merged == nil && our != nil:
+      result.Deleted++
+    case merged != nil && !sameEntry(merged, our):
+      result.Changed++
+    }
+    if merged != nil {
+      if closedSheets[merged.sheet] {
+        result.Inboxed++
+      }
+      result.entries = append(result.entries, *merged)
+    }
+  }
+
+  result.mergeDebts(base, ours, theirs)
+  return result, nil
+}
+
+
+// *******************************
+// Conflict between two versions of an entry
+// *******************************
+func entryConflict(id string, our, their *auditEntry) MergeConflict {
+  describe := func(item *auditEntry) string {
+    if item == nil {
+      return ""
+    }
+    return describeEntry(item.entry) + " in " + item.sheet
+  }
+  return MergeConflict{
+    Kind: "entry",
+    ID: id,
+    Ours: describe(our),
+    Theirs: describe(their),
+    resolve: func(doc *Document, useTheirs bool) {
+      chosen := our
+      if useTheirs {
+        chosen = their
+      }
+      if chosen != nil {
+        doc.placeMerged(*chosen)
+      }
+    },
+  }
+}
+
+
+// *******************************
+// Previous debts changed differently in both copies are conflicts
+// *******************************
+func (result *MergeResult) mergeDebts(base, ours, theirs *Document) {
+  names := []string{}
+  for name := range ours.PrevDebt {
+    names = append(names, name)
+  }
+  for name := range theirs.PrevDebt {
+    if _, ok := ours.PrevDebt[name]; !ok {
+      names = append(names, name)
+    }
+  }
+  sort.Strings(names)
+
+  debt := func(debts map[string]float64, name string) *float64 {
+    if value, ok := debts[name]; ok {
+      return &value
+    }
+    return nil
+  }
+  same := func(a, b *float64) bool {
+    if a == nil || b == nil {
+      return a == nil && b == nil
+    }
+    return *a == *b
+  }
+  describe := func(value *float64) string {
+    if value == nil {
+      return ""
+    }
+    return strconv.FormatFloat(*value, 'f', 2, 64)
+  }
+
+  for _, name := range names {
+    our := debt(ours.PrevDebt, name)
+    their := debt(theirs.PrevDebt, name)
+    var common *float64
+    if base != nil {
+      common = debt(base.PrevDebt, name)
+    }
+
+    switch {
+    case same(our, their), same(their, common):
+      continue
+    case same(our, common):
+      result.doc.setDebt(name, their)
+      continue
+    }
+
+    name := name
+    result.Conflicts = append(result.Conflicts, MergeConflict{
+      Kind: "debt",
+      ID: name,
+      Ours: describe(our),
+      Theirs: describe(their),
+      resolve: func(doc *Document, useTheirs bool) {
+        if useTheirs {
+          doc.setDebt(name, their)
+        } else {
+          doc.setDebt(name, our)
+        }
+      },
+    })
+  }
+}
+
+
+// *******************************
+// Set or remove the previous debt of a payer
+// *******************************
+func (doc *Document) setDebt(name string, debt *float64) {
+  if debt == nil {
+    delete(doc.PrevDebt, name)
+    return
+  }
+  if doc.PrevDebt == nil {
+    doc.PrevDebt = map[string]float64{}
+  }
+  doc.PrevDebt[name] = *debt
+}
+
+
+// *******************************
+// Put a merged entry back in its sheet, or in the inbox
+// if the sheet doesn't exist or is closed
+// *******************************
+func (doc *Document) placeMerged(item auditEntry) {
+  for index := range doc.MonthRecs {
+    if doc.MonthRecs[index].GroupName == item.sheet && !doc.MonthRecs[index].Closed {
+      doc.MonthRecs[index].EntryRecords = append(doc.MonthRecs[index].EntryRecords, item.entry)
+      return
+    }
+  }
+  doc.Inbox = append(doc.Inbox, item.entry)
+}
+
+
+// *******************************
+// Merged document with the conflicts solved as chosen,
+// ours when not chosen
+// *******************************
+func (result *MergeResult) build(choices map[string]string) (*Document, error) {
+  snapshot, err := result.doc.snapshot()
+  if err != nil {
+    return nil, err
+  }
+  doc, err := fromSnapshot(snapshot)
+  if err != nil {
+    return nil, err
+  }
+  doc.Audit = append([]AuditEvent{}, result.doc.Audit...)
+  doc.Operations = append([]Operation{}, result.doc.Operations...)
+  doc.passphrase = result.doc.passphrase
+
+  for _, item := range result.entries {
+    doc.placeMerged(item)
+  }
+  for _, conflict := range result.Conflicts {
+    conflict.resolve(doc, choices[conflict.Kind + ":" + conflict.ID] == mergeTheirs)
+  }
+  for index := range doc.MonthRecs {
+    doc.MonthRecs[index].sortRecordsByDate()
+  }
+  if len(doc.MonthRecs) > 0 {
+    doc.MonthRecs[len(doc.MonthRecs) - 1].ActiveGroup = true
+  }
+  doc.invalidateAllStats()
+  doc.calcAllStats()
+  return doc, nil
+}
+
+
+// *******************************
+// Command line: apunta merge [-base base.json] [-o merged.json] a.json b.json
+// Conflicts are listed and solved with the preferred copy,
+// exit status is 2 when there were conflicts
+// *******************************
+func runMerge(args []string) int {
+  flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+  basePath := flags.String("base", "", "common ancestor of both copies")
+  output := flags.String("o", "merged.json", "file to write the merged document")
+  prefer := flags.String("prefer", mergeOurs, "copy used to solve conflicts: ours (first file) or theirs")
+  if err := flags.Parse(args); err != nil {
+    return 1
+  }
+  if flags.NArg() != 2 || (*prefer != mergeOurs && *prefer != mergeTheirs) {
+    fmt.Println("Usage: apunta merge [-base base.json] [-o merged.json] [-prefer ours|theirs] a.json|a.db b.json|b.db")
+    return 1
+  }
+  store, err := openStorage(*output)
+  if err != nil {
+    fmt.Println(err)
+    return 1
+  }
+
+  passphrase := os.Getenv(passphraseEnv)
+  var docs []*Document
+  for _, path := range append([]string{*basePath}, flags.Args()...) {
+    if path == "" {
+      docs = append(docs, nil)
+      continue
+    }
+    doc, err := storageForFile(path).Load(passphrase)
+    if err != nil {
+      fmt.Println(path + ": " + err.Error())
+      return 1
+    }
+    docs = append(docs, doc)
+  }
+
+  result, err := mergeDocuments(docs[0], docs[1], docs[2])
+  if err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  choices := map[string]string{}
+  for _, conflict := range result.Conflicts {
+    fmt.Printf("Conflict in %s %s:\n  ours:   %s\n  theirs: %s\n", conflict.Kind, conflict.ID, orDeleted(conflict.Ours), orDeleted(conflict.Theirs))
+    choices[conflict.Kind + ":" + conflict.ID] = *prefer
+  }
+
+  // Receipts of the entries taken from theirs are copied too, before
+  // the storage saves them along with the document
+  merged, err := result.build(choices)
+  if err == nil {
+    err = merged.copyAttachments(passphrase, attachmentsDirOf(store.String()),
+      attachmentsDirOf(flags.Arg(0)), attachmentsDirOf(flags.Arg(1)))
+  }
+  if err == nil {
+    err = store.Save(merged, "")
+  }
+  if err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  fmt.Printf("Merged into %s: %d added, %d deleted, %d changed, %d conflicts solved with %s\n",
+    store, result.Added, result.Deleted, result.Changed, len(result.Conflicts), *prefer)
+  if notice := result.ClosedNotice(); notice != "" {
+    fmt.Println(notice)
+  }
+  if len(result.Conflicts) > 0 {
+    return 2
+  }
+  return 0
+}
+
+func orDeleted(description string) string {
+  if description == "" {
+    return "(deleted)"
+  }
+  return description
+}
+
+
+// *******************************
+// Page to merge another copy into the document
+// *******************************
+func (doc *Document) renderMerge(w http.ResponseWriter, notices ...string) {
+  data := struct {
+    Doc      *Document
+    Result   *MergeResult
+    Notices  []string
+  }{doc, doc.pendingMerge, notices}
+  if err := mergeTpl.Execute(w, data); err != nil {
+    fmt.Println(err)
+  }
+}
+
+
+// *******************************
+// Read an uploaded copy, missing files are nil
+// *******************************
+func (doc *Document) uploadedDocument(r *http.Request, field string) (*Document, error) {
+  file, _, err := r.FormFile(field)
+  if err == http.ErrMissingFile {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  data, err := ioutil.ReadAll(file)
+  if err != nil {
+    return nil, err
+  }
+  return decodeDocument(data, doc.passphrase)
+}
+
+
+// *******************************
+// Upload another copy and show the merge result with its conflicts
+// *******************************
+func (doc *Document) mergeHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      doc.renderMerge(w)
+      return
+    }
+    if r.FormValue("cancel") != "" {
+      doc.pendingMerge = nil
+      doc.renderMerge(w, "Merge cancelled")
+      return
+    }
+
+    theirs, err := doc.uploadedDocument(r, "theirs")
+    if err == nil && theirs == nil {
+      err = fmt.Errorf("Choose the copy to merge")
+    }
+    var base *Document
+    if err == nil {
+      base, err = doc.uploadedDocument(r, "base")
+    }
+    if err == nil {
+      doc.pendingMerge, err = mergeDocuments(base, doc, theirs)
+    }
+    if err != nil {
+      doc.pendingMerge = nil
+      doc.renderMerge(w, err.Error())
+      return
+    }
+    doc.renderMerge(w)
+  }
+}
+
+
+// *******************************
+// Apply the pending merge with the chosen side of each conflict
+// *******************************
+func (doc *Document) applyMergeHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    result := doc.pendingMerge
+    if result == nil {
+      doc.renderMerge(w, "Nothing to merge")
+      return
+    }
+
+    choices := map[string]string{}
+    for _, conflict := range result.Conflicts {
+      key := conflict.Kind + ":" + conflict.ID
+      choices[key] = r.FormValue(key)
+    }
+    merged, err := result.build(choices)
+    if err == nil {
+      var snapshot []byte
+      snapshot, err = merged.snapshot()
+      if err == nil {
+        err = doc.restore(snapshot)
+      }
+    }
+    if err != nil {
+      doc.renderMerge(w, err.Error())
+      return
+    }
+
+    doc.Audit = merged.Audit
+    doc.pendingMerge = nil
+    doc.addNotice(fmt.Sprintf("Merged: %d added, %d deleted, %d changed, %d conflicts solved",
+      result.Added, result.Deleted, result.Changed, len(result.Conflicts)))
+    if notice := result.ClosedNotice(); notice != "" {
+      doc.addNotice(notice)
+    }
+    doc.render(w, r)
+  }
+}
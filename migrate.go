@@ -0,0 +1,98 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "time"
+)
+
+const (
+  // Version of the document format written by this program
+  documentVersion = 2
+)
+
+// Payer names used as shared-expense markers before groups existed
+var legacySharedNames = []string{"All", "B"}
+
+
+// *******************************
+// Bring documents written by older versions to the current format
+// *******************************
+func (doc *Document) migrate() {
+  if doc.Version < 1 {
+    doc.migrateSharedPayers()
+  }
+  if doc.Version < 2 {
+    doc.migrateEntryIDs()
+  }
+
+  doc.Version = documentVersion
+}
+
+
+// *******************************
+// Version 1: "All" and "B" payers become the default shared group
+// *******************************
+func (doc *Document) migrateSharedPayers() {
+  if _, ok := doc.findGroup(defaultGroupName); !ok {
+    doc.Groups = append(doc.Groups, PayerGroup{Name: defaultGroupName})
+  }
+
+  for monthIdx := range doc.MonthRecs {
+    for entryIdx, entry := range doc.MonthRecs[monthIdx].EntryRecords {
+      for _, legacyName := range legacySharedNames {
+        if entry.PersonName == legacyName {
+          entry.PersonName = ""
+          entry.SharedGroup = defaultGroupName
+          doc.MonthRecs[monthIdx].EntryRecords[entryIdx] = entry
+          break
+        }
+      }
+    }
+  }
+
+  for _, legacyName := range legacySharedNames {
+    doc.Payers = removeStr(doc.Payers, legacyName)
+    doc.InactivePayers = removeStr(doc.InactivePayers, legacyName)
+    if doc.LastUsedPayer == legacyName {
+      doc.LastUsedPayer = ""
+      doc.LastUsedGroup = defaultGroupName
+    }
+  }
+}
+
+
+// *******************************
+// Version 2: every entry gets an identifier, derived from its
+// content so copies of the same file get the same ones
+// *******************************
+func (doc *Document) migrateEntryIDs() {
+  seen := map[string]int{}
+  for monthIdx := range doc.MonthRecs {
+    month := &doc.MonthRecs[monthIdx]
+    for entryIdx := range month.EntryRecords {
+      if month.EntryRecords[entryIdx].ID == "" {
+        month.EntryRecords[entryIdx].ID = legacyEntryID(month.GroupName, month.EntryRecords[entryIdx], seen)
+      }
+    }
+  }
+  for inboxIdx := range doc.Inbox {
+    if doc.Inbox[inboxIdx].ID == "" {
+      doc.Inbox[inboxIdx].ID = legacyEntryID("Inbox", doc.Inbox[inboxIdx], seen)
+    }
+  }
+}
+
+
+// *******************************
+// Identifier of an entry from its sheet and content, repeated
+// entries are told apart by their order
+// *******************************
+func legacyEntryID(sheet string, entry EntryRec, seen map[string]int) string {
+  key := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%v|%s", sheet, entry.Date.Format(time.RFC3339), entry.Category,
+    entry.PersonName, entry.SharedGroup, entry.Currency, entry.Amount, entry.Comment)
+  seen[key]++
+  sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", key, seen[key])))
+  return hex.EncodeToString(sum[:8])
+}
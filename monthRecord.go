@@ -1,7 +1,6 @@
 package main
 
 import (
-  "fmt"
   "time"
   "sort"
 
@@ -13,13 +12,22 @@ const (
 )
 
 type EntryRec struct {
+  ID         string
+  Kind       string
+  RefundOf   string
   Date       time.Time
   Category   string
   PersonName string
+  SharedGroup string
   Currency   string
   ExchRate   float64
+  ManualRate bool
+  RateError  string
   Amount     float64
   Comment    string
+  CreatedBy  string
+  // Receipt in the attachments directory, named by its content
+  Attachment string
 }
 
 type ExRateEntry struct {
@@ -40,11 +48,17 @@ type MonthStats struct {
 
 type MonthRec struct {
   StartDate     time.Time
+  EndDate       time.Time
   GroupName     string
   ActiveGroup   bool
+  Closed        bool
+  ClosedDate    time.Time
   AvgExchRates  []ExRateEntry
   Stats         MonthStats
   EntryRecords  []EntryRec
+
+  // Stats are up to date with the entries, not stored
+  statsValid    bool
 }
 
 
@@ -80,7 +94,8 @@ func (month *MonthRec) ExchRatesCalcs() []ExRateEntry {
   checked_entries := map[string]map[time.Time]int{}
   same_date_entries := []int{}
   for index, entryRec := range month.EntryRecords {
-    if entryRec.Currency != "EUR" {
+    // Rates entered by hand are kept and not used for other entries
+    if entryRec.Currency != "EUR" && !entryRec.ManualRate {
       // Check if currency was already seen
       if dates_map, curr_ok := checked_entries[entryRec.Currency]; curr_ok {
         // check if date was already seen
@@ -113,9 +128,13 @@ func (month *MonthRec) ExchRatesCalcs() []ExRateEntry {
           defer func() { <- queue }()
           rate, err := exchRates.GetRate(_curr, "EUR", _date)
           if err != nil {
-            fmt.Println(err)
+            // Leave the rate unknown to be requested again later
+            month.EntryRecords[_index].ExchRate = 0.0
+            month.EntryRecords[_index].RateError = err.Error()
+            return
           }
           month.EntryRecords[_index].ExchRate = rate
+          month.EntryRecords[_index].RateError = ""
         }(curr, date, index)
       }
     }
@@ -130,14 +149,22 @@ func (month *MonthRec) ExchRatesCalcs() []ExRateEntry {
   for _, index := range same_date_entries {
     downloaded_rate_idx := checked_entries[month.EntryRecords[index].Currency][month.EntryRecords[index].Date]
     month.EntryRecords[index].ExchRate = month.EntryRecords[downloaded_rate_idx].ExchRate
+    month.EntryRecords[index].RateError = month.EntryRecords[downloaded_rate_idx].RateError
   }
 
-  // Calculate average per currency
+  // Calculate average per currency, skipping failed rates
   avg_curr := map[string]float64{}
   for curr, map_dates := range checked_entries {
-    num_elems := len(map_dates)
+    num_elems := 0
     for _, index := range map_dates {
-      avg_curr[curr] += month.EntryRecords[index].ExchRate
+      if month.EntryRecords[index].ExchRate > 0.0 {
+        avg_curr[curr] += month.EntryRecords[index].ExchRate
+        num_elems++
+      }
+    }
+    if num_elems == 0 {
+      delete(avg_curr, curr)
+      continue
     }
     avg_curr[curr] = avg_curr[curr]/float64(num_elems)
   }
@@ -145,14 +172,17 @@ func (month *MonthRec) ExchRatesCalcs() []ExRateEntry {
   // set the caulcated exchange rates to the month
   for curr, avg_val := range avg_curr {
     // Check if rate was already set
+    already_set := false
     for i, saved_avg_rate := range month.AvgExchRates {
       if saved_avg_rate.CurrFrom == curr {
         month.AvgExchRates[i].AvgVal = avg_val
-      } else {
-        new_rate := ExRateEntry{curr, "EUR", avg_val}
-        month.AvgExchRates = append(month.AvgExchRates, new_rate)
+        already_set = true
       }
     }
+    if !already_set {
+      new_rate := ExRateEntry{curr, "EUR", avg_val}
+      month.AvgExchRates = append(month.AvgExchRates, new_rate)
+    }
   }
 
   return month.AvgExchRates
@@ -163,7 +193,7 @@ func (month *MonthRec) ExchRatesCalcs() []ExRateEntry {
 // *******************************
 // Calculate statistics for this month
 // *******************************
-func (month *MonthRec) calcStats(prevMonth *MonthRec, prevDebtData map[string]float64) MonthStats {
+func (month *MonthRec) calcStats(prevMonth *MonthRec, prevDebtData map[string]float64, groups []PayerGroup, rateMode string) MonthStats {
 
   // Reset stats if recalculating the whole month / init map
   month.Stats.AllPayersStats = map[string]PayerStats{}
@@ -185,40 +215,47 @@ func (month *MonthRec) calcStats(prevMonth *MonthRec, prevDebtData map[string]fl
   }
 
   // Calculate spent
-  allSpent := make([]float64, 0)
+  sharedSpent := map[string]float64{}
   for _, dayRec := range month.EntryRecords {
 
     // Set value for exchange rate
-    rate_val := 1.0
-    for _, month_rate := range month.AvgExchRates {
-      if month_rate.CurrFrom == dayRec.Currency {
-        rate_val = month_rate.AvgVal
-      }
-    }
+    rate_val := month.entryRate(dayRec, rateMode)
 
-    // Store special case for all to process at the end
-    // Skip special case statistics
-    if dayRec.PersonName == "B" || dayRec.PersonName == "All" {
-      allSpent = append(allSpent, dayRec.Amount * rate_val)
+    // Store shared expenses to process at the end
+    if dayRec.SharedGroup != "" {
+      sharedSpent[dayRec.SharedGroup] += dayRec.signedAmount() * rate_val
       continue
     }
 
     if stats, ok := month.Stats.AllPayersStats[dayRec.PersonName]; ok {
       // Key already thare, add
-      stats.Spent += (dayRec.Amount * rate_val)
+      stats.Spent += (dayRec.signedAmount() * rate_val)
       month.Stats.AllPayersStats[dayRec.PersonName] = stats
     } else {
       // no key, just create the value
-      stats = PayerStats{(dayRec.Amount * rate_val), 0.0, 0.0}
+      stats = PayerStats{(dayRec.signedAmount() * rate_val), 0.0, 0.0}
       month.Stats.AllPayersStats[dayRec.PersonName] = stats
     }
   }
 
-  // Divide "All" costs between all payers
-  numPayers := float64(len(month.Stats.AllPayersStats))
-  for _, entrySpent := range allSpent {
-    for key, value := range month.Stats.AllPayersStats {
-      value.Spent += entrySpent/numPayers
+  // Divide shared costs between the group members
+  // Groups without members, or unknown groups, are shared by all payers
+  allPayers := make([]string, 0, len(month.Stats.AllPayersStats))
+  for key := range month.Stats.AllPayersStats {
+    allPayers = append(allPayers, key)
+  }
+  for groupName, groupSpent := range sharedSpent {
+    members := allPayers
+    for _, group := range groups {
+      if group.Name == groupName && len(group.Members) > 0 {
+        members = group.Members
+      }
+    }
+
+    numPayers := float64(len(members))
+    for _, key := range members {
+      value := month.Stats.AllPayersStats[key]
+      value.Spent += groupSpent/numPayers
       month.Stats.AllPayersStats[key] = PayerStats{value.Spent, value.Accum, value.Debt}
     }
   }
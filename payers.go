@@ -0,0 +1,285 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+
+// *******************************
+// Check if a payer is in the list of payers
+// *******************************
+func (doc *Document) hasPayer(name string) bool {
+  for _, payer := range doc.Payers {
+    if payer == name {
+      return true
+    }
+  }
+  return false
+}
+
+
+// *******************************
+// Check if a payer was marked as inactive
+// *******************************
+func (doc *Document) IsInactivePayer(name string) bool {
+  for _, payer := range doc.InactivePayers {
+    if payer == name {
+      return true
+    }
+  }
+  return false
+}
+
+
+// *******************************
+// Payers shown in the dropdowns, inactive ones are left out
+// *******************************
+func (doc *Document) ActivePayers() []string {
+  active := make([]string, 0, len(doc.Payers))
+  for _, payer := range doc.Payers {
+    if !doc.IsInactivePayer(payer) {
+      active = append(active, payer)
+    }
+  }
+  return active
+}
+
+
+// *******************************
+// Check if a slice contains a string
+// *******************************
+func containsStr(x []string, y string) bool {
+  for _, elem := range x {
+    if elem == y {
+      return true
+    }
+  }
+  return false
+}
+
+
+// *******************************
+// Remove all occurrences of a string from a slice
+// *******************************
+func removeStr(x []string, y string) []string {
+  result := x[:0]
+  for _, elem := range x {
+    if elem != y {
+      result = append(result, elem)
+    }
+  }
+  return result
+}
+
+
+// *******************************
+// Remove repeated strings from a slice keeping the first occurrence
+// *******************************
+func uniqueStr(x []string) []string {
+  seen := map[string]bool{}
+  result := x[:0]
+  for _, elem := range x {
+    if !seen[elem] {
+      seen[elem] = true
+      result = append(result, elem)
+    }
+  }
+  return result
+}
+
+
+// *******************************
+// Replace the payer name in every place it is used: entries,
+// previous debts, month statistics and last used values
+// *******************************
+func (doc *Document) replacePayer(oldName, newName string) {
+  for monthIdx := range doc.MonthRecs {
+    month := &doc.MonthRecs[monthIdx]
+    for entryIdx := range month.EntryRecords {
+      if month.EntryRecords[entryIdx].PersonName == oldName {
+        month.EntryRecords[entryIdx].PersonName = newName
+      }
+    }
+
+    if stats, ok := month.Stats.AllPayersStats[oldName]; ok {
+      merged := month.Stats.AllPayersStats[newName]
+      merged.Spent += stats.Spent
+      merged.Accum += stats.Accum
+      merged.Debt += stats.Debt
+      month.Stats.AllPayersStats[newName] = merged
+      delete(month.Stats.AllPayersStats, oldName)
+    }
+  }
+
+  if debtValue, ok := doc.PrevDebt[oldName]; ok {
+    doc.PrevDebt[newName] += debtValue
+    delete(doc.PrevDebt, oldName)
+  }
+
+  for groupIdx := range doc.Groups {
+    group := &doc.Groups[groupIdx]
+    for memberIdx, member := range group.Members {
+      if member == oldName {
+        group.Members[memberIdx] = newName
+      }
+    }
+    group.Members = uniqueStr(group.Members)
+  }
+
+  // Entries waiting in the inbox are assigned under the new name
+  for entryIdx := range doc.Inbox {
+    if doc.Inbox[entryIdx].PersonName == oldName {
+      doc.Inbox[entryIdx].PersonName = newName
+    }
+  }
+
+  // Recurring entries keep being created for the new name
+  for recIdx := range doc.Recurring {
+    if doc.Recurring[recIdx].PersonName == oldName {
+      doc.Recurring[recIdx].PersonName = newName
+    }
+  }
+
+  if doc.LastUsedPayer == oldName {
+    doc.LastUsedPayer = newName
+  }
+}
+
+
+// *******************************
+// Rename a payer keeping its position in the list
+// *******************************
+func (doc *Document) renamePayer(oldName, newName string) error {
+  if oldName == "" || newName == "" {
+    return fmt.Errorf("Payer names can not be empty")
+  }
+  if !doc.hasPayer(oldName) {
+    return fmt.Errorf("Payer %s does not exist", oldName)
+  }
+  if doc.hasPayer(newName) {
+    return fmt.Errorf("Payer %s already exists, merge the payers instead", newName)
+  }
+
+  for index, payer := range doc.Payers {
+    if payer == oldName {
+      doc.Payers[index] = newName
+    }
+  }
+  for index, payer := range doc.InactivePayers {
+    if payer == oldName {
+      doc.InactivePayers[index] = newName
+    }
+  }
+
+  doc.replacePayer(oldName, newName)
+  doc.invalidateAllStats()
+  return nil
+}
+
+
+// *******************************
+// Merge a payer into another one, the first one disappears
+// *******************************
+func (doc *Document) mergePayers(fromName, intoName string) error {
+  if fromName == intoName {
+    return fmt.Errorf("Can not merge payer %s with itself", fromName)
+  }
+  if !doc.hasPayer(fromName) {
+    return fmt.Errorf("Payer %s does not exist", fromName)
+  }
+  if !doc.hasPayer(intoName) {
+    return fmt.Errorf("Payer %s does not exist", intoName)
+  }
+  // Renames only move the frozen totals, merges would add them up
+  if month, ok := doc.closedMonthUsing(fromName, ""); ok {
+    return fmt.Errorf("Payer %s is used in closed month %s, reopen it to merge the payers", fromName, month)
+  }
+
+  doc.Payers = removeStr(doc.Payers, fromName)
+  doc.InactivePayers = removeStr(doc.InactivePayers, fromName)
+
+  doc.replacePayer(fromName, intoName)
+  doc.invalidateAllStats()
+  return nil
+}
+
+
+// *******************************
+// Mark a payer as inactive or active again
+// Inactive payers are kept in the history but not offered in dropdowns
+// *******************************
+func (doc *Document) setPayerActive(name string, active bool) error {
+  if !doc.hasPayer(name) {
+    return fmt.Errorf("Payer %s does not exist", name)
+  }
+
+  doc.InactivePayers = removeStr(doc.InactivePayers, name)
+  if !active {
+    doc.InactivePayers = append(doc.InactivePayers, name)
+  }
+  return nil
+}
+
+
+// *******************************
+// Rename payer from form, with the accounts linked to it
+// *******************************
+func (doc *Document) renamePayerHandler(users *UserStore) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    oldName := strings.TrimSpace(r.FormValue("oldPayer"))
+    newName := strings.TrimSpace(r.FormValue("newPayerName"))
+
+    err := doc.renamePayer(oldName, newName)
+    if err == nil {
+      err = users.relinkPayer(doc, oldName, newName)
+    }
+    if err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Merge payers from form, with the accounts linked to them
+// *******************************
+func (doc *Document) mergePayersHandler(users *UserStore) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    fromName := strings.TrimSpace(r.FormValue("fromPayer"))
+    intoName := strings.TrimSpace(r.FormValue("intoPayer"))
+
+    err := doc.mergePayers(fromName, intoName)
+    if err == nil {
+      err = users.relinkPayer(doc, fromName, intoName)
+    }
+    if err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Toggle payer active state from form
+// *******************************
+func (doc *Document) togglePayerHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSpace(r.FormValue("togglePayer"))
+
+    if err := doc.setPayerActive(name, doc.IsInactivePayer(name)); err != nil {
+      fmt.Println(err)
+    }
+
+    doc.render(w, r)
+  }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+  "time"
+)
+
+
+// *******************************
+// Calendar day of a date, independent of time and location
+// *******************************
+func dayOf(date time.Time) time.Time {
+  return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+
+// *******************************
+// Last day included in the period
+// Sheets without end date cover the calendar month of their start
+// *******************************
+func (month *MonthRec) PeriodEnd() time.Time {
+  if !month.EndDate.IsZero() {
+    return month.EndDate
+  }
+  return month.StartDate.AddDate(0, 1, -1)
+}
+
+
+// *******************************
+// Check if a date falls within the period of the sheet
+// *******************************
+func (month *MonthRec) contains(date time.Time) bool {
+  day := dayOf(date)
+  return !day.Before(dayOf(month.StartDate)) && !day.After(dayOf(month.PeriodEnd()))
+}
+
+
+// *******************************
+// Length of the period in days
+// *******************************
+func (month *MonthRec) periodDays() int {
+  return int(dayOf(month.PeriodEnd()).Sub(dayOf(month.StartDate)).Hours() / 24) + 1
+}
+
+
+// *******************************
+// Find the open sheet an entry with this date belongs to
+// When periods overlap the active sheet wins, then the shortest
+// period (a trip inside a month), then the one starting last
+// *******************************
+func (doc *Document) findPeriodFor(date time.Time) (int, bool) {
+  found := -1
+  for index := range doc.MonthRecs {
+    month := &doc.MonthRecs[index]
+    if month.Closed || !month.contains(date) {
+      continue
+    }
+    if month.ActiveGroup {
+      return index, true
+    }
+    if found < 0 {
+      found = index
+      continue
+    }
+
+    best := &doc.MonthRecs[found]
+    if month.periodDays() < best.periodDays() ||
+      (month.periodDays() == best.periodDays() && month.StartDate.After(best.StartDate)) {
+      found = index
+    }
+  }
+  return found, found >= 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+const (
+  // Conversion modes of a document: the average rate of the month
+  // for all entries of a currency, or the rate of every entry
+  rateModeAverage = ""
+  rateModeEntry   = "entry"
+)
+
+
+// *******************************
+// Average exchange rate to EUR of a currency in this month
+// *******************************
+func (month *MonthRec) avgRate(currency string) float64 {
+  rate_val := 1.0
+  for _, month_rate := range month.AvgExchRates {
+    if month_rate.CurrFrom == currency {
+      rate_val = month_rate.AvgVal
+    }
+  }
+  return rate_val
+}
+
+
+// *******************************
+// Exchange rate to EUR used for an entry of this month
+// Rates entered by hand always win, fetched rates of the entry
+// are only used in per-entry mode
+// *******************************
+func (month *MonthRec) entryRate(entry EntryRec, rateMode string) float64 {
+  if entry.ManualRate && entry.ExchRate > 0.0 {
+    return entry.ExchRate
+  }
+  if rateMode == rateModeEntry && entry.ExchRate > 0.0 {
+    return entry.ExchRate
+  }
+  return month.avgRate(entry.Currency)
+}
+
+
+// *******************************
+// Currencies of entries converted without a known rate, so the
+// totals of the month are incomplete
+// *******************************
+func (month *MonthRec) MissingRates(rateMode string) []string {
+  var missing []string
+  for _, entry := range month.EntryRecords {
+    if entry.Currency == "EUR" || containsStr(missing, entry.Currency) {
+      continue
+    }
+    if entry.ExchRate > 0.0 && (entry.ManualRate || rateMode == rateModeEntry) {
+      continue
+    }
+    known := false
+    for _, rate := range month.AvgExchRates {
+      if rate.CurrFrom == entry.Currency && rate.AvgVal > 0.0 {
+        known = true
+      }
+    }
+    if !known {
+      missing = append(missing, entry.Currency)
+    }
+  }
+  sort.Strings(missing)
+  return missing
+}
+
+
+// *******************************
+// Set by hand the exchange rate of an entry
+// A zero rate goes back to the fetched or average rate
+// *******************************
+func (doc *Document) setEntryRate(id string, rate float64) error {
+  if rate < 0.0 {
+    return fmt.Errorf("Exchange rate can not be negative")
+  }
+  for monthIdx := range doc.MonthRecs {
+    month := &doc.MonthRecs[monthIdx]
+    for entryIdx := range month.EntryRecords {
+      if month.EntryRecords[entryIdx].ID != id {
+        continue
+      }
+      if month.Closed {
+        return fmt.Errorf("Month %s is closed", month.GroupName)
+      }
+      month.EntryRecords[entryIdx].ExchRate = rate
+      month.EntryRecords[entryIdx].ManualRate = rate > 0.0
+      doc.invalidateStats(monthIdx)
+      return nil
+    }
+  }
+  return fmt.Errorf("Entry %s does not exist", id)
+}
+
+
+// *******************************
+// Set entry exchange rate from form
+// *******************************
+func (doc *Document) setEntryRateHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    rate := 0.0
+    if rateValue := strings.TrimSpace(r.FormValue("rate")); rateValue != "" {
+      convRate, err := strconv.ParseFloat(rateValue, 64)
+      if err != nil {
+        doc.addNotice(err.Error())
+        doc.render(w, r)
+        return
+      }
+      rate = convRate
+    }
+
+    if entry, ok := doc.findEntry(r.FormValue("entryID")); ok && !doc.canEditEntry(currentUser(r), *entry) {
+      doc.addNotice("Only the owners or the author of an entry can edit it")
+    } else if err := doc.setEntryRate(r.FormValue("entryID"), rate); err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Change the conversion mode of the document from form
+// *******************************
+func (doc *Document) setRateMode() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    mode := r.FormValue("rateMode")
+    if mode == rateModeAverage || mode == rateModeEntry {
+      doc.RateMode = mode
+      doc.invalidateAllStats()
+    } else {
+      doc.addNotice(fmt.Sprintf("Unknown conversion mode %s", mode))
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // Number of months shown in the upcoming recurring entries preview
+  recurringPreviewMonths = 3
+)
+
+// Template for entries repeated every few months on a fixed day
+type RecurringEntry struct {
+  Name         string
+  Category     string
+  PersonName   string
+  SharedGroup  string
+  Currency     string
+  Amount       float64
+  Comment      string
+  DayOfMonth   int
+  EveryMonths  int
+  StartDate    time.Time
+  EndDate      time.Time
+}
+
+
+// *******************************
+// Number of whole months between the months of two dates
+// *******************************
+func monthsBetween(from, to time.Time) int {
+  return (to.Year() - from.Year()) * 12 + int(to.Month()) - int(from.Month())
+}
+
+
+// *******************************
+// Date of the occurrence in the month of the given date, if any
+// Days past the end of the month are moved to its last day
+// *******************************
+func (rec RecurringEntry) occurrenceIn(monthDate time.Time) (time.Time, bool) {
+  every := rec.EveryMonths
+  if every < 1 {
+    every = 1
+  }
+
+  elapsed := monthsBetween(rec.StartDate, monthDate)
+  if elapsed < 0 || elapsed % every != 0 {
+    return time.Time{}, false
+  }
+
+  firstDay := time.Date(monthDate.Year(), monthDate.Month(), 1, 0, 0, 0, 0, monthDate.Location())
+  lastDay := firstDay.AddDate(0, 1, -1).Day()
+  day := rec.DayOfMonth
+  if day < 1 {
+    day = 1
+  } else if day > lastDay {
+    day = lastDay
+  }
+
+  date := firstDay.AddDate(0, 0, day - 1)
+  if date.Before(rec.StartDate) || (!rec.EndDate.IsZero() && date.After(rec.EndDate)) {
+    return time.Time{}, false
+  }
+  return date, true
+}
+
+
+// *******************************
+// Build the entry created by a recurring template
+// *******************************
+func (rec RecurringEntry) toEntry(date time.Time) EntryRec {
+  entry := EntryRec{
+    ID: newEntryID(),
+    Date: date,
+    Category: rec.Category,
+    PersonName: rec.PersonName,
+    SharedGroup: rec.SharedGroup,
+    Currency: rec.Currency,
+    Amount: rec.Amount,
+    Comment: rec.Comment,
+  }
+  if entry.Currency == "EUR" {
+    entry.ExchRate = 1.0
+  }
+  return entry
+}
+
+
+// *******************************
+// Create the entries of all recurring templates for a new sheet
+// *******************************
+func (doc *Document) materializeRecurring(month *MonthRec) {
+  firstMonth := time.Date(month.StartDate.Year(), month.StartDate.Month(), 1, 0, 0, 0, 0, month.StartDate.Location())
+  numMonths := monthsBetween(month.StartDate, month.PeriodEnd()) + 1
+
+  for i := 0; i < numMonths; i++ {
+    monthDate := firstMonth.AddDate(0, i, 0)
+    for _, rec := range doc.Recurring {
+      if date, ok := rec.occurrenceIn(monthDate); ok && month.contains(date) {
+        month.EntryRecords = append(month.EntryRecords, rec.toEntry(date))
+      }
+    }
+  }
+  month.sortRecordsByDate()
+}
+
+
+// *******************************
+// Occurrences of the recurring templates in the coming months
+// *******************************
+func (doc *Document) upcomingRecurring(from time.Time, months int) []EntryRec {
+  upcoming := make([]EntryRec, 0)
+  for i := 0; i < months; i++ {
+    monthDate := time.Date(from.Year(), from.Month() + time.Month(i), 1, 0, 0, 0, 0, from.Location())
+    for _, rec := range doc.Recurring {
+      if date, ok := rec.occurrenceIn(monthDate); ok && !date.Before(from) {
+        upcoming = append(upcoming, rec.toEntry(date))
+      }
+    }
+  }
+
+  sort.SliceStable(upcoming, func(i, j int) bool {
+    return upcoming[i].Date.Before(upcoming[j].Date)
+  })
+  return upcoming
+}
+
+
+// *******************************
+// Preview of upcoming recurring entries, used by the template
+// *******************************
+func (doc *Document) UpcomingRecurring() []EntryRec {
+  now := time.Now()
+  today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+  return doc.upcomingRecurring(today, recurringPreviewMonths)
+}
+
+
+// *******************************
+// Add recurring entry template from form
+// *******************************
+func (doc *Document) addRecurring() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    defer doc.render(w, r)
+
+    rec := RecurringEntry{
+      Name: strings.TrimSpace(r.FormValue("recName")),
+      Category: r.FormValue("recCategory"),
+      PersonName: r.FormValue("recWho"),
+      SharedGroup: r.FormValue("recShared"),
+      Currency: r.FormValue("recCurrency"),
+      Comment: r.FormValue("recComment"),
+      EveryMonths: 1,
+    }
+    if rec.SharedGroup != "" {
+      rec.PersonName = ""
+    }
+
+    for _, existing := range doc.Recurring {
+      if existing.Name == rec.Name {
+        fmt.Printf("Recurring entry %s already exists\n", rec.Name)
+        return
+      }
+    }
+
+    amount, err := strconv.ParseFloat(r.FormValue("recQuantity"), 64)
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    rec.Amount = amount
+
+    day, err := strconv.Atoi(r.FormValue("recDay"))
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    rec.DayOfMonth = day
+
+    if every, err := strconv.Atoi(r.FormValue("recEvery")); err == nil && every > 0 {
+      rec.EveryMonths = every
+    }
+
+    startDate, err := time.ParseInLocation("2006-01", r.FormValue("recStart"), time.Now().Location())
+    if err != nil {
+      fmt.Println(err)
+      return
+    }
+    rec.StartDate = startDate
+
+    if endValue := r.FormValue("recEnd"); endValue != "" {
+      endDate, err := time.ParseInLocation("2006-01", endValue, time.Now().Location())
+      if err != nil {
+        fmt.Println(err)
+        return
+      }
+      // Include the whole last month
+      rec.EndDate = endDate.AddDate(0, 1, -1)
+    }
+
+    doc.Recurring = append(doc.Recurring, rec)
+  }
+}
+
+
+// *******************************
+// Remove recurring entry template from form
+// Entries already created are kept
+// *******************************
+func (doc *Document) removeRecurring() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := r.FormValue("recName")
+
+    for index, rec := range doc.Recurring {
+      if rec.Name == name {
+        doc.Recurring = append(doc.Recurring[:index], doc.Recurring[index + 1:]...)
+        break
+      }
+    }
+
+    doc.render(w, r)
+  }
+}
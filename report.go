@@ -0,0 +1,205 @@
+package main
+
+import (
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "html/template"
+  "net/http"
+  "sort"
+  "strconv"
+  "time"
+)
+
+var (
+  reportTpl = template.Must(template.ParseFiles("report.html"))
+)
+
+// Total of a category, payer or currency over the report range
+type ReportRow struct {
+  Name     string
+  Total    float64
+  Average  float64
+}
+
+// Spending of a single month compared with the month before
+type MonthSummary struct {
+  GroupName    string
+  StartDate    time.Time
+  Total        float64
+  Income       float64
+  Net          float64
+  Change       float64
+  ChangePct    float64
+  PerCategory  map[string]float64
+}
+
+type Report struct {
+  FromDate        time.Time
+  ToDate          time.Time
+  Months          []MonthSummary
+  Categories      []ReportRow
+  Payers          []ReportRow
+  Currencies      []ReportRow
+  Total           float64
+  Income          float64
+  Net             float64
+  MonthlyAverage  float64
+  Doc             *Document `json:"-"`
+}
+
+
+// *******************************
+// Convert accumulated totals to rows sorted by name
+// *******************************
+func reportRows(totals map[string]float64, numMonths int) []ReportRow {
+  rows := make([]ReportRow, 0, len(totals))
+  for name, total := range totals {
+    row := ReportRow{Name: name, Total: total}
+    if numMonths > 0 {
+      row.Average = total / float64(numMonths)
+    }
+    rows = append(rows, row)
+  }
+  sort.Slice(rows, func(i, j int) bool {
+    return rows[i].Name < rows[j].Name
+  })
+  return rows
+}
+
+
+// *******************************
+// Aggregate the sheets starting within the given range, from
+// the month of fromDate to the end of the month of toDate
+// Statistics are assumed to be calculated
+// *******************************
+func (doc *Document) buildReport(fromDate, toDate time.Time) Report {
+  report := Report{FromDate: fromDate, ToDate: toDate, Months: make([]MonthSummary, 0), Doc: doc}
+  endDate := time.Date(toDate.Year(), toDate.Month() + 1, 1, 0, 0, 0, 0, toDate.Location())
+
+  categories := map[string]float64{}
+  payers := map[string]float64{}
+  currencies := map[string]float64{}
+
+  for index := range doc.MonthRecs {
+    month := &doc.MonthRecs[index]
+    if month.StartDate.Before(fromDate) || !month.StartDate.Before(endDate) {
+      continue
+    }
+
+    summary := MonthSummary{
+      GroupName: month.GroupName,
+      StartDate: month.StartDate,
+    }
+    summary.PerCategory = month.categoryTotals(doc.RateMode)
+    for category, value := range summary.PerCategory {
+      summary.Total += value
+      categories[category] += value
+    }
+    for _, entry := range month.EntryRecords {
+      if entry.isSpending() {
+        currencies[entry.Currency] += entry.signedAmount()
+      }
+    }
+    summary.Income = month.Income(doc.RateMode)
+    summary.Net = summary.Income - summary.Total
+    for name, stats := range month.Stats.AllPayersStats {
+      payers[name] += stats.Spent
+    }
+
+    if numMonths := len(report.Months); numMonths > 0 {
+      prevTotal := report.Months[numMonths - 1].Total
+      summary.Change = summary.Total - prevTotal
+      if prevTotal != 0.0 {
+        summary.ChangePct = 100.0 * summary.Change / prevTotal
+      }
+    }
+
+    report.Total += summary.Total
+    report.Income += summary.Income
+    report.Net += summary.Net
+    report.Months = append(report.Months, summary)
+  }
+
+  numMonths := len(report.Months)
+  if numMonths > 0 {
+    report.MonthlyAverage = report.Total / float64(numMonths)
+  }
+  report.Categories = reportRows(categories, numMonths)
+  report.Payers = reportRows(payers, numMonths)
+  report.Currencies = reportRows(currencies, numMonths)
+
+  return report
+}
+
+
+// *******************************
+// Read the report range from the request, current year by default
+// *******************************
+func parseReportRange(r *http.Request) (time.Time, time.Time) {
+  now := time.Now()
+  fromDate := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+  toDate := time.Date(now.Year(), 12, 1, 0, 0, 0, 0, now.Location())
+
+  if year, err := strconv.Atoi(r.FormValue("year")); err == nil {
+    fromDate = time.Date(year, 1, 1, 0, 0, 0, 0, now.Location())
+    toDate = time.Date(year, 12, 1, 0, 0, 0, 0, now.Location())
+  }
+  if parsed, err := time.ParseInLocation("2006-01", r.FormValue("from"), now.Location()); err == nil {
+    fromDate = parsed
+  }
+  if parsed, err := time.ParseInLocation("2006-01", r.FormValue("to"), now.Location()); err == nil {
+    toDate = parsed
+  }
+  return fromDate, toDate
+}
+
+
+// *******************************
+// Write the report as CSV, one line per month and category
+// *******************************
+func (report *Report) writeCSV(w *csv.Writer) error {
+  if err := w.Write([]string{"Month", "Category", "Amount EUR"}); err != nil {
+    return err
+  }
+  for _, month := range report.Months {
+    for _, row := range reportRows(month.PerCategory, 1) {
+      record := []string{month.GroupName, row.Name, strconv.FormatFloat(row.Total, 'f', 2, 64)}
+      if err := w.Write(record); err != nil {
+        return err
+      }
+    }
+  }
+  w.Flush()
+  return w.Error()
+}
+
+
+// *******************************
+// Show the report for a range of months
+// ?format=json or ?format=csv export it instead
+// *******************************
+func (doc *Document) reportHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    doc.sortMonthsByDate()
+    doc.calcAllStats()
+
+    report := doc.buildReport(parseReportRange(r))
+
+    var err error
+    switch r.FormValue("format") {
+    case "json":
+      w.Header().Set("Content-Type", "application/json")
+      err = json.NewEncoder(w).Encode(report)
+    case "csv":
+      w.Header().Set("Content-Type", "text/csv")
+      w.Header().Set("Content-Disposition", "attachment; filename=\"apunta_report.csv\"")
+      err = report.writeCSV(csv.NewWriter(w))
+    default:
+      err = reportTpl.Execute(w, report)
+    }
+    if err != nil {
+      fmt.Println(err)
+    }
+  }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+const (
+  // Owners edit everything, members only their own entries and
+  // viewers can only look
+  roleOwner  = "owner"
+  roleMember = "member"
+  roleViewer = "viewer"
+)
+
+// Higher ranks include the permissions of the lower ones
+var roleRank = map[string]int{
+  roleViewer: 1,
+  roleMember: 2,
+  roleOwner: 3,
+}
+
+
+// *******************************
+// Role of a user in this document
+// Documents without roles, or requests without users, are open
+// *******************************
+func (doc *Document) roleOf(user *UserAccount) string {
+  if user == nil || len(doc.Roles) == 0 {
+    return roleOwner
+  }
+  return doc.Roles[user.Name]
+}
+
+
+// *******************************
+// Check if a user has at least the given role
+// *******************************
+func (doc *Document) hasRole(user *UserAccount, role string) bool {
+  return roleRank[doc.roleOf(user)] >= roleRank[role]
+}
+
+
+// *******************************
+// Check if a user can edit an entry: owners edit all of them,
+// members those they created or paid
+// *******************************
+func (doc *Document) canEditEntry(user *UserAccount, entry EntryRec) bool {
+  if doc.hasRole(user, roleOwner) {
+    return true
+  }
+  if !doc.hasRole(user, roleMember) {
+    return false
+  }
+  if entry.CreatedBy != "" {
+    return entry.CreatedBy == user.Name
+  }
+  return entry.PersonName != "" && entry.PersonName == user.Payer
+}
+
+
+// *******************************
+// Reject requests of users without the role
+// *******************************
+func (doc *Document) allow(role string, next http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if !doc.hasRole(currentUser(r), role) {
+      http.Error(w, "Forbidden: " + role + " role needed", http.StatusForbidden)
+      return
+    }
+    next(w, r)
+  }
+}
+
+
+// *******************************
+// Give a role to a user, an empty role removes the access
+// The last owner can not be removed
+// *******************************
+func (doc *Document) setRole(userName, role string) error {
+  if userName == "" {
+    return fmt.Errorf("User name can not be empty")
+  }
+  if _, ok := roleRank[role]; !ok && role != "" {
+    return fmt.Errorf("Unknown role %s", role)
+  }
+
+  if doc.Roles == nil {
+    doc.Roles = map[string]string{}
+  }
+  if doc.Roles[userName] == roleOwner && role != roleOwner {
+    owners := 0
+    for _, userRole := range doc.Roles {
+      if userRole == roleOwner {
+        owners++
+      }
+    }
+    if owners == 1 {
+      return fmt.Errorf("%s is the last owner of the document", userName)
+    }
+  }
+
+  if role == "" {
+    delete(doc.Roles, userName)
+  } else {
+    doc.Roles[userName] = role
+  }
+  return nil
+}
+
+
+// *******************************
+// Set user role from form
+// The first role given must be an owner, to not lock everybody out
+// *******************************
+func (doc *Document) setRoleHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    userName := strings.TrimSpace(r.FormValue("roleUser"))
+    role := r.FormValue("role")
+
+    if len(doc.Roles) == 0 && role != roleOwner {
+      if user := currentUser(r); user != nil {
+        doc.setRole(user.Name, roleOwner)
+      }
+    }
+    if err := doc.setRole(userName, role); err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.render(w, r)
+  }
+}
+
+
+// *******************************
+// Role of the logged in user, used by the template
+// *******************************
+func (page pageData) Role() string {
+  return page.roleOf(page.User)
+}
+
+func (page pageData) IsOwner() bool {
+  return page.hasRole(page.User, roleOwner)
+}
+
+func (page pageData) IsMember() bool {
+  return page.hasRole(page.User, roleMember)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "html/template"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+var (
+  searchTpl = template.Must(template.ParseFiles("search.html"))
+)
+
+// Criteria to filter entries, empty values match everything
+type EntryFilter struct {
+  Text       string
+  Category   string
+  Payer      string
+  Currency   string
+  FromDate   time.Time
+  ToDate     time.Time
+  MinAmount  *float64
+  MaxAmount  *float64
+}
+
+type SearchMatch struct {
+  GroupName   string
+  Entry       EntryRec
+  BaseAmount  float64
+}
+
+type SearchResult struct {
+  Filter        EntryFilter
+  Matches       []SearchMatch
+  Total         float64
+  CurrTotals    map[string]float64
+  Doc           *Document `json:"-"`
+}
+
+
+// *******************************
+// Check if an entry fulfills all the filter criteria
+// *******************************
+func (filter *EntryFilter) matches(entry EntryRec) bool {
+  if filter.Text != "" && !strings.Contains(strings.ToLower(entry.Comment), strings.ToLower(filter.Text)) {
+    return false
+  }
+  if filter.Category != "" && entry.Category != filter.Category {
+    return false
+  }
+  if filter.Payer != "" && entry.PersonName != filter.Payer && entry.SharedGroup != filter.Payer {
+    return false
+  }
+  if filter.Currency != "" && entry.Currency != filter.Currency {
+    return false
+  }
+  if !filter.FromDate.IsZero() && entry.Date.Before(filter.FromDate) {
+    return false
+  }
+  if !filter.ToDate.IsZero() && entry.Date.After(filter.ToDate) {
+    return false
+  }
+  if filter.MinAmount != nil && entry.Amount < *filter.MinAmount {
+    return false
+  }
+  if filter.MaxAmount != nil && entry.Amount > *filter.MaxAmount {
+    return false
+  }
+  return true
+}
+
+
+// *******************************
+// Find entries in all months matching the filter
+// *******************************
+func (doc *Document) searchEntries(filter EntryFilter) SearchResult {
+  result := SearchResult{
+    Filter: filter,
+    Matches: make([]SearchMatch, 0),
+    CurrTotals: map[string]float64{},
+    Doc: doc,
+  }
+
+  for index := range doc.MonthRecs {
+    month := &doc.MonthRecs[index]
+    for _, entry := range month.EntryRecords {
+      if filter.matches(entry) {
+        baseAmount := entry.signedAmount() * month.entryRate(entry, doc.RateMode)
+        result.Matches = append(result.Matches, SearchMatch{month.GroupName, entry, baseAmount})
+        result.Total += baseAmount
+        result.CurrTotals[entry.Currency] += entry.signedAmount()
+      }
+    }
+  }
+  return result
+}
+
+
+// *******************************
+// Read the filter criteria from the request
+// *******************************
+func parseEntryFilter(r *http.Request) EntryFilter {
+  filter := EntryFilter{
+    Text: strings.TrimSpace(r.FormValue("text")),
+    Category: r.FormValue("category"),
+    Payer: r.FormValue("payer"),
+    Currency: r.FormValue("currency"),
+  }
+
+  if fromDate, err := time.ParseInLocation("2006-01-02", r.FormValue("from"), time.Now().Location()); err == nil {
+    filter.FromDate = fromDate
+  }
+  if toDate, err := time.ParseInLocation("2006-01-02", r.FormValue("to"), time.Now().Location()); err == nil {
+    // Include the whole last day
+    filter.ToDate = toDate.Add(24 * time.Hour - time.Nanosecond)
+  }
+  if minAmount, err := strconv.ParseFloat(r.FormValue("min"), 64); err == nil {
+    filter.MinAmount = &minAmount
+  }
+  if maxAmount, err := strconv.ParseFloat(r.FormValue("max"), 64); err == nil {
+    filter.MaxAmount = &maxAmount
+  }
+  return filter
+}
+
+
+// *******************************
+// Search entries and show them in the search page
+// *******************************
+func (doc *Document) searchHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    result := doc.searchEntries(parseEntryFilter(r))
+
+    if err := searchTpl.Execute(w, result); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
+
+
+// *******************************
+// Search entries and return them as JSON
+// *******************************
+func (doc *Document) searchApiHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    result := doc.searchEntries(parseEntryFilter(r))
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(result); err != nil {
+      fmt.Println(err)
+    }
+  }
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+
+// *******************************
+// Find an open sheet by name
+// *******************************
+func (doc *Document) findOpenSheet(name string) (int, error) {
+  for index, month := range doc.MonthRecs {
+    if month.GroupName == name {
+      if month.Closed {
+        return -1, fmt.Errorf("Month %s is closed", name)
+      }
+      return index, nil
+    }
+  }
+  return -1, fmt.Errorf("Sheet %s does not exist", name)
+}
+
+
+// *******************************
+// Rename a sheet
+// *******************************
+func (doc *Document) renameSheet(oldName, newName string) error {
+  if newName == "" {
+    return fmt.Errorf("Sheet name can not be empty")
+  }
+  if doc.hasSheet(newName) {
+    return fmt.Errorf("Name %s was already used.", newName)
+  }
+  index, err := doc.findOpenSheet(oldName)
+  if err != nil {
+    return err
+  }
+
+  doc.MonthRecs[index].GroupName = newName
+  return nil
+}
+
+
+// *******************************
+// Delete a sheet, sheets with entries are only deleted if forced
+// *******************************
+func (doc *Document) deleteSheet(name string, force bool) error {
+  index, err := doc.findOpenSheet(name)
+  if err != nil {
+    return err
+  }
+  if len(doc.MonthRecs[index].EntryRecords) > 0 && !force {
+    return fmt.Errorf("Sheet %s has %d entries, confirm to delete them", name, len(doc.MonthRecs[index].EntryRecords))
+  }
+
+  wasActive := doc.MonthRecs[index].ActiveGroup
+  doc.MonthRecs = append(doc.MonthRecs[:index], doc.MonthRecs[index + 1:]...)
+  doc.invalidateStats(index)
+  if wasActive && len(doc.MonthRecs) > 0 {
+    doc.MonthRecs[len(doc.MonthRecs) - 1].ActiveGroup = true
+  }
+  return nil
+}
+
+
+// *******************************
+// Merge a sheet into another one, the period of the remaining
+// sheet is extended to cover both
+// *******************************
+func (doc *Document) mergeSheets(fromName, intoName string) error {
+  if fromName == intoName {
+    return fmt.Errorf("Can not merge sheet %s with itself", fromName)
+  }
+  fromIdx, err := doc.findOpenSheet(fromName)
+  if err != nil {
+    return err
+  }
+  intoIdx, err := doc.findOpenSheet(intoName)
+  if err != nil {
+    return err
+  }
+
+  from := doc.MonthRecs[fromIdx]
+  into := &doc.MonthRecs[intoIdx]
+
+  endDate := into.PeriodEnd()
+  if from.PeriodEnd().After(endDate) {
+    endDate = from.PeriodEnd()
+  }
+  if from.StartDate.Before(into.StartDate) {
+    into.StartDate = from.StartDate
+  }
+  into.EndDate = endDate
+
+  into.EntryRecords = append(into.EntryRecords, from.EntryRecords...)
+  into.sortRecordsByDate()
+  into.statsValid = false
+
+  // Keep the rates of currencies only known by the merged sheet
+  for _, fromRate := range from.AvgExchRates {
+    known := false
+    for _, intoRate := range into.AvgExchRates {
+      if intoRate.CurrFrom == fromRate.CurrFrom {
+        known = true
+      }
+    }
+    if !known {
+      into.AvgExchRates = append(into.AvgExchRates, fromRate)
+    }
+  }
+
+  doc.MonthRecs = append(doc.MonthRecs[:fromIdx], doc.MonthRecs[fromIdx + 1:]...)
+  doc.invalidateStats(fromIdx)
+  doc.sortMonthsByDate()
+  doc.markMonthAsActive(intoName)
+  return nil
+}
+
+
+// *******************************
+// Move entries, given by their position, between sheets
+// *******************************
+func (doc *Document) moveEntries(fromName, toName string, entryIdxs []int) error {
+  if fromName == toName {
+    return nil
+  }
+  fromIdx, err := doc.findOpenSheet(fromName)
+  if err != nil {
+    return err
+  }
+  toIdx, err := doc.findOpenSheet(toName)
+  if err != nil {
+    return err
+  }
+
+  from := &doc.MonthRecs[fromIdx]
+  selected := map[int]bool{}
+  for _, entryIdx := range entryIdxs {
+    if entryIdx < 0 || entryIdx >= len(from.EntryRecords) {
+      return fmt.Errorf("Entry %d does not exist in sheet %s", entryIdx, fromName)
+    }
+    selected[entryIdx] = true
+  }
+
+  kept := make([]EntryRec, 0, len(from.EntryRecords))
+  for entryIdx, entry := range from.EntryRecords {
+    if selected[entryIdx] {
+      doc.MonthRecs[toIdx].EntryRecords = append(doc.MonthRecs[toIdx].EntryRecords, entry)
+    } else {
+      kept = append(kept, entry)
+    }
+  }
+  from.EntryRecords = kept
+  doc.MonthRecs[toIdx].sortRecordsByDate()
+  doc.invalidateStats(fromIdx)
+  doc.invalidateStats(toIdx)
+  return nil
+}
+
+
+// *******************************
+// Parse the positions of the selected entries
+// *******************************
+func parseIndexes(values []string) []int {
+  indexes := make([]int, 0, len(values))
+  for _, value := range values {
+    if index, err := strconv.Atoi(value); err == nil {
+      indexes = append(indexes, index)
+    }
+  }
+  sort.Ints(indexes)
+  return indexes
+}
+
+
+// *******************************
+// Rename, delete, merge sheets and move entries from form
+// ?action=rename|delete|merge|move
+// *******************************
+func (doc *Document) editSheet() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    sheetName := r.FormValue("sheet")
+    targetName := strings.TrimSpace(r.FormValue("target"))
+
+    var err error
+    switch r.FormValue("action") {
+    case "rename":
+      err = doc.renameSheet(sheetName, targetName)
+    case "delete":
+      err = doc.deleteSheet(sheetName, r.FormValue("confirm") != "")
+    case "merge":
+      err = doc.mergeSheets(sheetName, targetName)
+    case "move":
+      err = doc.moveEntries(sheetName, targetName, parseIndexes(r.Form["entry"]))
+    default:
+      err = fmt.Errorf("Unknown sheet action %s", r.FormValue("action"))
+    }
+    if err != nil {
+      doc.addNotice(err.Error())
+    }
+
+    doc.calcAllStats()
+
+    doc.render(w, r)
+  }
+}
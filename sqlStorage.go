@@ -0,0 +1,493 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  _ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteExt = ".db"
+
+// Tables of a document database, one document per file
+// Settings without table are stored as JSON in the documents table
+var sqlSchema = []string{
+  `CREATE TABLE IF NOT EXISTS documents (
+    id        INTEGER PRIMARY KEY,
+    version   INTEGER NOT NULL,
+    settings  TEXT NOT NULL,
+    saved_at  TEXT NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS categories (
+    document  INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    position  INTEGER NOT NULL,
+    name      TEXT NOT NULL,
+    PRIMARY KEY (document, position)
+  )`,
+  `CREATE TABLE IF NOT EXISTS payers (
+    document  INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    position  INTEGER NOT NULL,
+    name      TEXT NOT NULL,
+    inactive  INTEGER NOT NULL,
+    PRIMARY KEY (document, position)
+  )`,
+  `CREATE TABLE IF NOT EXISTS currencies (
+    document  INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    position  INTEGER NOT NULL,
+    name      TEXT NOT NULL,
+    PRIMARY KEY (document, position)
+  )`,
+  `CREATE TABLE IF NOT EXISTS months (
+    document     INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    position     INTEGER NOT NULL,
+    name         TEXT NOT NULL,
+    start_date   TEXT NOT NULL,
+    end_date     TEXT NOT NULL,
+    active       INTEGER NOT NULL,
+    closed       INTEGER NOT NULL,
+    closed_date  TEXT NOT NULL,
+    stats        TEXT NOT NULL,
+    PRIMARY KEY (document, position)
+  )`,
+  `CREATE TABLE IF NOT EXISTS rates (
+    document   INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    month      INTEGER NOT NULL,
+    position   INTEGER NOT NULL,
+    curr_from  TEXT NOT NULL,
+    curr_to    TEXT NOT NULL,
+    value      REAL NOT NULL,
+    PRIMARY KEY (document, month, position)
+  )`,
+  // Entries of the inbox have no month
+  `CREATE TABLE IF NOT EXISTS entries (
+    document      INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+    month         INTEGER,
+    position      INTEGER NOT NULL,
+    id            TEXT NOT NULL,
+    kind          TEXT NOT NULL,
+    refund_of     TEXT NOT NULL,
+    date          TEXT NOT NULL,
+    category      TEXT NOT NULL,
+    payer         TEXT NOT NULL,
+    shared_group  TEXT NOT NULL,
+    currency      TEXT NOT NULL,
+    exch_rate     REAL NOT NULL,
+    manual_rate   INTEGER NOT NULL,
+    rate_error    TEXT NOT NULL,
+    amount        REAL NOT NULL,
+    comment       TEXT NOT NULL,
+    created_by    TEXT NOT NULL,
+    attachment    TEXT NOT NULL DEFAULT ''
+  )`,
+  `CREATE INDEX IF NOT EXISTS entries_by_month ON entries (document, month, position)`,
+}
+
+// The only document of a database file
+const sqlDocumentID = 1
+
+// Document stored in an embedded SQLite database
+type sqlStorage struct {
+  path  string
+}
+
+
+// *******************************
+// Database storage of a file, which can not be encrypted
+// *******************************
+func newSqlStorage(path string) (sqlStorage, error) {
+  if os.Getenv(passphraseEnv) != "" {
+    return sqlStorage{}, fmt.Errorf("The SQLite storage can not encrypt documents, unset %s", passphraseEnv)
+  }
+  return sqlStorage{path}, nil
+}
+
+
+func (store sqlStorage) String() string {
+  return store.path
+}
+
+
+// *******************************
+// Times are stored as text, empty for zero times
+// *******************************
+func sqlTime(date time.Time) string {
+  if date.IsZero() {
+    return ""
+  }
+  return date.Format(time.RFC3339Nano)
+}
+
+func parseSqlTime(text string) (time.Time, error) {
+  if text == "" {
+    return time.Time{}, nil
+  }
+  return time.Parse(time.RFC3339Nano, text)
+}
+
+
+// *******************************
+// Open the database and create the tables if needed
+// *******************************
+func (store sqlStorage) open() (*sql.DB, error) {
+  db, err := sql.Open("sqlite3", "file:" + store.path + "?_foreign_keys=on&_busy_timeout=5000")
+  if err != nil {
+    return nil, err
+  }
+  for _, statement := range sqlSchema {
+    if _, err := db.Exec(statement); err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+  // Databases written before receipts lack their column
+  if _, err := db.Exec(`SELECT attachment FROM entries LIMIT 0`); err != nil {
+    if _, err := db.Exec(`ALTER TABLE entries ADD COLUMN attachment TEXT NOT NULL DEFAULT ''`); err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+  return db, nil
+}
+
+
+// *******************************
+// Save the whole document in one transaction
+// *******************************
+func (store sqlStorage) Save(doc *Document, user string) error {
+  if doc.passphrase != "" {
+    return fmt.Errorf("The SQLite storage can not encrypt documents, unset %s", passphraseEnv)
+  }
+  db, err := store.open()
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  if err := writeSqlDocument(tx, doc); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+
+// *******************************
+// Replace the rows of the document
+// *******************************
+func writeSqlDocument(tx *sql.Tx, doc *Document) error {
+  if _, err := tx.Exec(`DELETE FROM documents WHERE id = ?`, sqlDocumentID); err != nil {
+    return err
+  }
+
+  // Settings are the document without the values stored in tables
+  settings := *doc
+  settings.Categories = nil
+  settings.Payers = nil
+  settings.InactivePayers = nil
+  settings.Currencies = nil
+  settings.MonthRecs = nil
+  settings.Inbox = nil
+  settingsJson, err := json.Marshal(settings)
+  if err != nil {
+    return err
+  }
+  _, err = tx.Exec(`INSERT INTO documents (id, version, settings, saved_at) VALUES (?, ?, ?, ?)`,
+    sqlDocumentID, doc.Version, string(settingsJson), sqlTime(time.Now()))
+  if err != nil {
+    return err
+  }
+
+  for table, names := range map[string][]string{"categories": doc.Categories, "currencies": doc.Currencies} {
+    for position, name := range names {
+      _, err := tx.Exec(`INSERT INTO ` + table + ` (document, position, name) VALUES (?, ?, ?)`, sqlDocumentID, position, name)
+      if err != nil {
+        return err
+      }
+    }
+  }
+  for position, name := range doc.Payers {
+    _, err := tx.Exec(`INSERT INTO payers (document, position, name, inactive) VALUES (?, ?, ?, ?)`,
+      sqlDocumentID, position, name, doc.IsInactivePayer(name))
+    if err != nil {
+      return err
+    }
+  }
+
+  for position, month := range doc.MonthRecs {
+    stats, err := json.Marshal(month.Stats)
+    if err != nil {
+      return err
+    }
+    _, err = tx.Exec(`INSERT INTO months (document, position, name, start_date, end_date, active, closed, closed_date, stats)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, sqlDocumentID, position, month.GroupName, sqlTime(month.StartDate),
+      sqlTime(month.EndDate), month.ActiveGroup, month.Closed, sqlTime(month.ClosedDate), string(stats))
+    if err != nil {
+      return err
+    }
+    for ratePosition, rate := range month.AvgExchRates {
+      _, err := tx.Exec(`INSERT INTO rates (document, month, position, curr_from, curr_to, value) VALUES (?, ?, ?, ?, ?, ?)`,
+        sqlDocumentID, position, ratePosition, rate.CurrFrom, rate.CurrTo, rate.AvgVal)
+      if err != nil {
+        return err
+      }
+    }
+    if err := writeSqlEntries(tx, position, month.EntryRecords); err != nil {
+      return err
+    }
+  }
+  return writeSqlEntries(tx, nil, doc.Inbox)
+}
+
+func writeSqlEntries(tx *sql.Tx, month interface{}, entries []EntryRec) error {
+  statement, err := tx.Prepare(`INSERT INTO entries (document, month, position, id, kind, refund_of, date, category,
+    payer, shared_group, currency, exch_rate, manual_rate, rate_error, amount, comment, created_by, attachment)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+  if err != nil {
+    return err
+  }
+  defer statement.Close()
+  for position, entry := range entries {
+    _, err := statement.Exec(sqlDocumentID, month, position, entry.ID, entry.Kind, entry.RefundOf, sqlTime(entry.Date),
+      entry.Category, entry.PersonName, entry.SharedGroup, entry.Currency, entry.ExchRate, entry.ManualRate,
+      entry.RateError, entry.Amount, entry.Comment, entry.CreatedBy, entry.Attachment)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// *******************************
+// Load the document, a missing file or document is reported
+// as not existing
+// *******************************
+func (store sqlStorage) Load(passphrase string) (*Document, error) {
+  if _, err := os.Stat(store.path); err != nil {
+    return nil, err
+  }
+  db, err := store.open()
+  if err != nil {
+    return nil, err
+  }
+  defer db.Close()
+
+  var settings string
+  err = db.QueryRow(`SELECT settings FROM documents WHERE id = ?`, sqlDocumentID).Scan(&settings)
+  if err == sql.ErrNoRows {
+    return nil, fmt.Errorf("%s has no document: %w", store.path, os.ErrNotExist)
+  } else if err != nil {
+    return nil, err
+  }
+
+  doc := newDocument()
+  doc.Version = 0
+  if err := json.Unmarshal([]byte(settings), doc); err != nil {
+    return nil, err
+  }
+  if err := readSqlDocument(db, doc); err != nil {
+    return nil, err
+  }
+  doc.migrate()
+  doc.sortMonthsByDate()
+  return doc, nil
+}
+
+
+// *******************************
+// Read the values stored in tables
+// *******************************
+func readSqlDocument(db *sql.DB, doc *Document) error {
+  var err error
+  if doc.Categories, err = readSqlNames(db, "categories", ""); err != nil {
+    return err
+  }
+  if doc.Currencies, err = readSqlNames(db, "currencies", ""); err != nil {
+    return err
+  }
+  if doc.Payers, err = readSqlNames(db, "payers", ""); err != nil {
+    return err
+  }
+  if doc.InactivePayers, err = readSqlNames(db, "payers", "AND inactive"); err != nil {
+    return err
+  }
+
+  rows, err := db.Query(`SELECT name, start_date, end_date, active, closed, closed_date, stats
+    FROM months WHERE document = ? ORDER BY position`, sqlDocumentID)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  doc.MonthRecs = nil
+  for rows.Next() {
+    month := newMonthRec()
+    var startDate, endDate, closedDate, stats string
+    if err := rows.Scan(&month.GroupName, &startDate, &endDate, &month.ActiveGroup, &month.Closed, &closedDate, &stats); err != nil {
+      return err
+    }
+    if month.StartDate, err = parseSqlTime(startDate); err != nil {
+      return err
+    }
+    if month.EndDate, err = parseSqlTime(endDate); err != nil {
+      return err
+    }
+    if month.ClosedDate, err = parseSqlTime(closedDate); err != nil {
+      return err
+    }
+    if err := json.Unmarshal([]byte(stats), &month.Stats); err != nil {
+      return err
+    }
+    doc.MonthRecs = append(doc.MonthRecs, *month)
+  }
+  if err := rows.Err(); err != nil {
+    return err
+  }
+
+  for position := range doc.MonthRecs {
+    month := &doc.MonthRecs[position]
+    if month.AvgExchRates, err = readSqlRates(db, position); err != nil {
+      return err
+    }
+    if month.EntryRecords, err = readSqlEntries(db, position); err != nil {
+      return err
+    }
+  }
+  doc.Inbox, err = readSqlEntries(db, nil)
+  return err
+}
+
+func readSqlNames(db *sql.DB, table, condition string) ([]string, error) {
+  rows, err := db.Query(`SELECT name FROM ` + table + ` WHERE document = ? ` + condition + ` ORDER BY position`, sqlDocumentID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var names []string
+  for rows.Next() {
+    var name string
+    if err := rows.Scan(&name); err != nil {
+      return nil, err
+    }
+    names = append(names, name)
+  }
+  return names, rows.Err()
+}
+
+func readSqlRates(db *sql.DB, month int) ([]ExRateEntry, error) {
+  rows, err := db.Query(`SELECT curr_from, curr_to, value FROM rates WHERE document = ? AND month = ? ORDER BY position`,
+    sqlDocumentID, month)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  rates := make([]ExRateEntry, 0)
+  for rows.Next() {
+    var rate ExRateEntry
+    if err := rows.Scan(&rate.CurrFrom, &rate.CurrTo, &rate.AvgVal); err != nil {
+      return nil, err
+    }
+    rates = append(rates, rate)
+  }
+  return rates, rows.Err()
+}
+
+func readSqlEntries(db *sql.DB, month interface{}) ([]EntryRec, error) {
+  condition := "month = ?"
+  args := []interface{}{sqlDocumentID, month}
+  if month == nil {
+    condition = "month IS NULL"
+    args = args[:1]
+  }
+  rows, err := db.Query(`SELECT id, kind, refund_of, date, category, payer, shared_group, currency, exch_rate,
+    manual_rate, rate_error, amount, comment, created_by, attachment FROM entries WHERE document = ? AND ` + condition +
+    ` ORDER BY position`, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  var entries []EntryRec
+  for rows.Next() {
+    var entry EntryRec
+    var date string
+    err := rows.Scan(&entry.ID, &entry.Kind, &entry.RefundOf, &date, &entry.Category, &entry.PersonName,
+      &entry.SharedGroup, &entry.Currency, &entry.ExchRate, &entry.ManualRate, &entry.RateError, &entry.Amount,
+      &entry.Comment, &entry.CreatedBy, &entry.Attachment)
+    if err != nil {
+      return nil, err
+    }
+    if entry.Date, err = parseSqlTime(date); err != nil {
+      return nil, err
+    }
+    entries = append(entries, entry)
+  }
+  return entries, rows.Err()
+}
+
+
+// *******************************
+// Storage of a file given by its extension: databases for .db,
+// JSON files for the rest
+// *******************************
+func storageForFile(path string) Storage {
+  if strings.EqualFold(filepath.Ext(path), sqliteExt) {
+    return sqlStorage{path}
+  }
+  return fileStorage{path}
+}
+
+
+// *******************************
+// Command line: apunta convert from.json to.db, or back
+// The storage of each file is given by its extension. Databases
+// are not encrypted, so encrypted documents need -allow-plaintext
+// *******************************
+func runConvert(args []string) int {
+  flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+  allowPlaintext := flags.Bool("allow-plaintext", false, "write an encrypted document into an unencrypted database")
+  if err := flags.Parse(args); err != nil {
+    return 1
+  }
+  if flags.NArg() != 2 {
+    fmt.Println("Usage: apunta convert [-allow-plaintext] from.json to.db | apunta convert from.db to.json")
+    return 1
+  }
+  args = flags.Args()
+  from, to := storageForFile(args[0]), storageForFile(args[1])
+
+  passphrase := os.Getenv(passphraseEnv)
+  doc, err := from.Load(passphrase)
+  if err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  if _, ok := to.(sqlStorage); ok {
+    if doc.passphrase != "" && !*allowPlaintext {
+      fmt.Println(args[0] + " is encrypted and " + args[1] + " would not be, use -allow-plaintext to convert it anyway")
+      return 1
+    }
+    doc.passphrase = ""
+  } else {
+    doc.passphrase = passphrase
+  }
+
+  if err := to.Save(doc, ""); err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  if err := doc.copyAttachments(passphrase, attachmentsDirOf(args[1]), attachmentsDirOf(args[0])); err != nil {
+    fmt.Println(err)
+    return 1
+  }
+  fmt.Printf("Converted %s into %s\n", from, to)
+  return 0
+}
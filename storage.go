@@ -0,0 +1,70 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+const storageEnv = "APUNTA_STORAGE"
+
+// Place where a document is kept between runs
+type Storage interface {
+  Load(passphrase string) (*Document, error)
+  // Save the document, changed by the given user
+  Save(doc *Document, user string) error
+  String() string
+}
+
+// Document stored as a JSON file, encrypted if it has a passphrase
+type fileStorage struct {
+  path  string
+}
+
+func (store fileStorage) Load(passphrase string) (*Document, error) {
+  return loadDocument(store.path, passphrase)
+}
+
+func (store fileStorage) Save(doc *Document, user string) error {
+  return doc.save(store.path)
+}
+
+func (store fileStorage) String() string {
+  return store.path
+}
+
+
+// *******************************
+// Storage of a document file, chosen with APUNTA_STORAGE:
+// "json" for plain files, "git" to commit every save, "sqlite"
+// for a database. When empty it is given by the file extension
+// *******************************
+func openStorage(path string) (Storage, error) {
+  switch kind := os.Getenv(storageEnv); kind {
+  case "":
+    if strings.EqualFold(filepath.Ext(path), sqliteExt) {
+      return newSqlStorage(path)
+    }
+    return fileStorage{path}, nil
+  case "json":
+    return fileStorage{path}, nil
+  case "git":
+    return newGitStorage(path)
+  case "sqlite":
+    return newSqlStorage(strings.TrimSuffix(path, filepath.Ext(path)) + sqliteExt)
+  default:
+    return nil, fmt.Errorf("Unknown storage %q", kind)
+  }
+}
+
+
+// *******************************
+// Audit events not saved yet
+// *******************************
+func (doc *Document) unsavedAudit() []AuditEvent {
+  if doc.savedAudit > len(doc.Audit) {
+    return nil
+  }
+  return doc.Audit[doc.savedAudit:]
+}
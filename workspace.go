@@ -0,0 +1,513 @@
+package main
+
+import (
+  "fmt"
+  "html/template"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const archiveDir = "archive"
+
+var (
+  workspaceTpl = template.Must(template.ParseFiles("workspace.html"))
+
+  // Names are used in file names and URLs
+  docNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Document file found in the workspace
+// The role is empty while the document was not opened
+type DocumentInfo struct {
+  Name      string
+  Archived  bool
+  Modified  time.Time
+  Role      string
+}
+
+// Directory with many documents, each one served under /doc/<name>/
+// Archived documents are moved to a subdirectory and not served
+type Workspace struct {
+  dir         string
+  passphrase  string
+  users       *UserStore
+  // Extension of the document files
+  ext         string
+
+  mutex       sync.Mutex
+  docs        map[string]*Document
+  handlers    map[string]http.Handler
+  // Roles of documents not served, by file, known once opened
+  roles       map[string]map[string]string
+  mux         *http.ServeMux
+  // Repository of the workspace when documents are stored in git
+  git         *gitStorage
+}
+
+
+// *******************************
+// Check if the path is an existing directory
+// *******************************
+func isDir(path string) bool {
+  info, err := os.Stat(path)
+  return err == nil && info.IsDir()
+}
+
+
+// *******************************
+// Open a workspace directory, creating it if needed
+// *******************************
+func openWorkspace(dir, passphrase string, users *UserStore) (*Workspace, error) {
+  if err := os.MkdirAll(filepath.Join(dir, archiveDir), 0755); err != nil {
+    return nil, err
+  }
+  ws := &Workspace{
+    dir: dir,
+    passphrase: passphrase,
+    users: users,
+    docs: map[string]*Document{},
+    handlers: map[string]http.Handler{},
+    roles: map[string]map[string]string{},
+    mux: http.NewServeMux(),
+    ext: ".json",
+  }
+  switch kind := os.Getenv(storageEnv); kind {
+  case "", "json":
+  case "sqlite":
+    if passphrase != "" {
+      return nil, fmt.Errorf("The SQLite storage can not encrypt documents, unset %s", passphraseEnv)
+    }
+    ws.ext = sqliteExt
+  case "git":
+    git, err := openGitRepo(dir)
+    if err != nil {
+      return nil, err
+    }
+    ws.git = git
+  default:
+    return nil, fmt.Errorf("Unknown storage %q", kind)
+  }
+
+  ws.mux.HandleFunc("/doc/", ws.documentHandler())
+  ws.mux.HandleFunc("/workspace/create", ws.createHandler())
+  ws.mux.HandleFunc("/workspace/rename", ws.renameHandler())
+  ws.mux.HandleFunc("/workspace/archive", ws.archiveHandler(true))
+  ws.mux.HandleFunc("/workspace/restore", ws.archiveHandler(false))
+  ws.mux.HandleFunc("/", ws.pickerHandler())
+  return ws, nil
+}
+
+func (ws *Workspace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  ws.mux.ServeHTTP(w, r)
+}
+
+
+// *******************************
+// Check that a document name can be used as file name and URL
+// *******************************
+func validDocName(name string) error {
+  if !docNamePattern.MatchString(name) {
+    return fmt.Errorf("Invalid document name %q: use letters, digits, - and _", name)
+  }
+  return nil
+}
+
+
+// *******************************
+// File of a document, active or archived
+// *******************************
+func (ws *Workspace) docPath(name string, archived bool) string {
+  if archived {
+    return filepath.Join(ws.dir, archiveDir, name + ws.ext)
+  }
+  return filepath.Join(ws.dir, name + ws.ext)
+}
+
+
+// *******************************
+// Check if the name is used by an active or archived document
+// *******************************
+func (ws *Workspace) exists(name string) bool {
+  for _, archived := range []bool{false, true} {
+    if _, err := os.Stat(ws.docPath(name, archived)); err == nil {
+      return true
+    }
+  }
+  return false
+}
+
+
+// *******************************
+// Storage of an active document
+// *******************************
+func (ws *Workspace) storage(name string) Storage {
+  if ws.git != nil {
+    return &gitStorage{fileStorage: fileStorage{ws.docPath(name, false)}, dir: ws.dir}
+  }
+  return ws.storageAt(ws.docPath(name, false))
+}
+
+
+// *******************************
+// Storage of a document file, active or archived, without git
+// *******************************
+func (ws *Workspace) storageAt(path string) Storage {
+  if ws.ext == sqliteExt {
+    return sqlStorage{path}
+  }
+  return fileStorage{path}
+}
+
+
+// *******************************
+// Commit a document moved in the workspace, when stored in git
+// *******************************
+func (ws *Workspace) commitMove(user *UserAccount, from, to string) error {
+  if ws.git == nil {
+    return nil
+  }
+  userName := ""
+  if user != nil {
+    userName = user.Name
+  }
+  return ws.git.commitMove(userName, from, to)
+}
+
+
+// *******************************
+// Serve the routes of a document under its name
+// Caller must hold the mutex
+// *******************************
+func (ws *Workspace) mount(name string, doc *Document) http.Handler {
+  doc.basePath = "/doc/" + name
+  handler := http.StripPrefix(doc.basePath, doc.routes(ws.users, ws.storage(name)))
+  ws.docs[name] = doc
+  ws.handlers[name] = handler
+  return handler
+}
+
+
+// *******************************
+// Active document with its routes, loaded on first use
+// Caller must hold the mutex
+// *******************************
+func (ws *Workspace) document(name string) (*Document, http.Handler, error) {
+  if err := validDocName(name); err != nil {
+    return nil, nil, err
+  }
+  if doc, ok := ws.docs[name]; ok {
+    return doc, ws.handlers[name], nil
+  }
+
+  doc, err := ws.storage(name).Load(ws.passphrase)
+  if err != nil {
+    return nil, nil, err
+  }
+  if ws.passphrase != "" {
+    doc.passphrase = ws.passphrase
+  }
+  return doc, ws.mount(name, doc), nil
+}
+
+
+// *******************************
+// Active or archived document, used to check the roles
+// Caller must hold the mutex
+// *******************************
+func (ws *Workspace) peek(name string, archived bool) (*Document, error) {
+  if !archived {
+    doc, _, err := ws.document(name)
+    return doc, err
+  }
+  if err := validDocName(name); err != nil {
+    return nil, err
+  }
+  doc, err := ws.storageAt(ws.docPath(name, true)).Load(ws.passphrase)
+  if err == nil {
+    ws.roles[ws.docPath(name, true)] = doc.Roles
+  }
+  return doc, err
+}
+
+
+// *******************************
+// Document with the known roles of a file, false if it was
+// not opened yet
+// Caller must hold the mutex
+// *******************************
+func (ws *Workspace) knownRoles(name string, archived bool) (*Document, bool) {
+  if doc, ok := ws.docs[name]; ok && !archived {
+    return doc, true
+  }
+  if roles, ok := ws.roles[ws.docPath(name, archived)]; ok {
+    return &Document{Roles: roles}, true
+  }
+  return nil, false
+}
+
+
+// *******************************
+// Documents in the workspace the user can see, sorted by name
+// Only file names and dates are read, documents are opened when
+// selected, so those not opened yet are listed without role
+// *******************************
+func (ws *Workspace) list(user *UserAccount) ([]DocumentInfo, error) {
+  ws.mutex.Lock()
+  defer ws.mutex.Unlock()
+
+  var infos []DocumentInfo
+  for _, archived := range []bool{false, true} {
+    dir := ws.dir
+    if archived {
+      dir = filepath.Join(ws.dir, archiveDir)
+    }
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+      return nil, err
+    }
+    for _, file := range files {
+      name := strings.TrimSuffix(file.Name(), ws.ext)
+      if file.IsDir() || filepath.Ext(file.Name()) != ws.ext || validDocName(name) != nil {
+        continue
+      }
+      info := DocumentInfo{Name: name, Archived: archived, Modified: file.ModTime()}
+      if doc, known := ws.knownRoles(name, archived); known {
+        if !doc.hasRole(user, roleViewer) {
+          continue
+        }
+        info.Role = doc.roleOf(user)
+      }
+      infos = append(infos, info)
+    }
+  }
+
+  sort.SliceStable(infos, func(i, j int) bool {
+    if infos[i].Archived != infos[j].Archived {
+      return !infos[i].Archived
+    }
+    return infos[i].Name < infos[j].Name
+  })
+  return infos, nil
+}
+
+
+// *******************************
+// Create an empty document, owned by the user creating it
+// *******************************
+func (ws *Workspace) create(name string, user *UserAccount) error {
+  ws.mutex.Lock()
+  defer ws.mutex.Unlock()
+
+  if err := validDocName(name); err != nil {
+    return err
+  }
+  if ws.exists(name) {
+    return fmt.Errorf("Document %s already exists", name)
+  }
+
+  doc := newDocument()
+  doc.passphrase = ws.passphrase
+  userName := ""
+  if user != nil {
+    userName = user.Name
+    doc.setRole(user.Name, roleOwner)
+  }
+  if err := ws.storage(name).Save(doc, userName); err != nil {
+    return err
+  }
+  ws.mount(name, doc)
+  return nil
+}
+
+
+// *******************************
+// Rename an active document, only for its owners
+// *******************************
+func (ws *Workspace) rename(oldName, newName string, user *UserAccount) error {
+  ws.mutex.Lock()
+  defer ws.mutex.Unlock()
+
+  doc, _, err := ws.document(oldName)
+  if err != nil {
+    return err
+  }
+  // Requests being served still use the old routes
+  doc.mutex.Lock()
+  defer doc.mutex.Unlock()
+  if !doc.hasRole(user, roleOwner) {
+    return fmt.Errorf("Only owners can rename %s", oldName)
+  }
+  if err := validDocName(newName); err != nil {
+    return err
+  }
+  if ws.exists(newName) {
+    return fmt.Errorf("Document %s already exists", newName)
+  }
+
+  if err := os.Rename(ws.docPath(oldName, false), ws.docPath(newName, false)); err != nil {
+    return err
+  }
+  delete(ws.docs, oldName)
+  delete(ws.handlers, oldName)
+  ws.mount(newName, doc)
+  return ws.commitMove(user, ws.docPath(oldName, false), ws.docPath(newName, false))
+}
+
+
+// *******************************
+// Move a document to the archive or back, only for its owners
+// Archiving saves the document first so no changes are lost
+// *******************************
+func (ws *Workspace) setArchived(name string, archived bool, user *UserAccount) error {
+  ws.mutex.Lock()
+  defer ws.mutex.Unlock()
+
+  doc, err := ws.peek(name, !archived)
+  if err != nil {
+    return err
+  }
+  // Only documents mounted by a request are being served
+  if doc.mutex != nil {
+    doc.mutex.Lock()
+    defer doc.mutex.Unlock()
+  }
+  if !doc.hasRole(user, roleOwner) {
+    return fmt.Errorf("Only owners can archive or restore %s", name)
+  }
+  if !archived {
+    if _, err := os.Stat(ws.docPath(name, false)); err == nil {
+      return fmt.Errorf("Document %s already exists", name)
+    }
+  }
+
+  if archived {
+    userName := ""
+    if user != nil {
+      userName = user.Name
+    }
+    if err := ws.storage(name).Save(doc, userName); err != nil {
+      return err
+    }
+  }
+  if err := os.Rename(ws.docPath(name, !archived), ws.docPath(name, archived)); err != nil {
+    return err
+  }
+  delete(ws.roles, ws.docPath(name, !archived))
+  if archived {
+    ws.roles[ws.docPath(name, true)] = doc.Roles
+  }
+  delete(ws.docs, name)
+  delete(ws.handlers, name)
+  return ws.commitMove(user, ws.docPath(name, !archived), ws.docPath(name, archived))
+}
+
+
+// *******************************
+// Render the document picker
+// *******************************
+func (ws *Workspace) render(w http.ResponseWriter, r *http.Request, notices ...string) {
+  user := currentUser(r)
+  infos, err := ws.list(user)
+  if err != nil {
+    notices = append(notices, err.Error())
+  }
+  data := struct {
+    User       *UserAccount
+    Documents  []DocumentInfo
+    Notices    []string
+  }{user, infos, notices}
+
+  if err := workspaceTpl.Execute(w, data); err != nil {
+    fmt.Println(err)
+  }
+}
+
+
+// *******************************
+// Document picker at the root of the workspace
+// *******************************
+func (ws *Workspace) pickerHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+      http.NotFound(w, r)
+      return
+    }
+    ws.render(w, r)
+  }
+}
+
+
+// *******************************
+// Pass requests under /doc/<name>/ to the routes of the document
+// *******************************
+func (ws *Workspace) documentHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/doc/"), "/", 2)[0]
+
+    ws.mutex.Lock()
+    _, handler, err := ws.document(name)
+    ws.mutex.Unlock()
+    if err != nil {
+      http.NotFound(w, r)
+      return
+    }
+
+    if r.URL.Path == "/doc/" + name {
+      http.Redirect(w, r, r.URL.Path + "/", http.StatusSeeOther)
+      return
+    }
+    handler.ServeHTTP(w, r)
+  }
+}
+
+
+// *******************************
+// Create document from form
+// *******************************
+func (ws *Workspace) createHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSpace(r.FormValue("docName"))
+    if err := ws.create(name, currentUser(r)); err != nil {
+      ws.render(w, r, err.Error())
+      return
+    }
+    http.Redirect(w, r, "/doc/" + name + "/", http.StatusSeeOther)
+  }
+}
+
+
+// *******************************
+// Rename document from form
+// *******************************
+func (ws *Workspace) renameHandler() http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    oldName := r.FormValue("docName")
+    newName := strings.TrimSpace(r.FormValue("newDocName"))
+    if err := ws.rename(oldName, newName, currentUser(r)); err != nil {
+      ws.render(w, r, err.Error())
+      return
+    }
+    ws.render(w, r)
+  }
+}
+
+
+// *******************************
+// Archive or restore document from form
+// *******************************
+func (ws *Workspace) archiveHandler(archived bool) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if err := ws.setArchived(r.FormValue("docName"), archived, currentUser(r)); err != nil {
+      ws.render(w, r, err.Error())
+      return
+    }
+    ws.render(w, r)
+  }
+}